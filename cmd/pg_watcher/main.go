@@ -4,6 +4,8 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
 	// NOTE: change this import to your real module path from go.mod
 	"github.com/maratos-ORG/pg_watcher/internal/watcher"
@@ -18,13 +20,21 @@ func main() {
 	// Parse CLI flags (includes -version printing using `build`)
 	fp, cp, err := watcher.ParseFlags(build)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintln(os.Stderr, watcher.Redact(err.Error()))
 		os.Exit(1)
 	}
 
+	// SIGINT/SIGTERM cancel in-flight queries and flush collected results;
+	// a second signal terminates immediately
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
 	// Run the tool
-	if err := watcher.Run(context.Background(), fp, cp); err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)	
+	if err := watcher.Run(ctx, fp, cp); err != nil {
+		fmt.Fprintln(os.Stderr, watcher.Redact(err.Error()))
+		os.Exit(1)
 	}
 }
@@ -0,0 +1,154 @@
+package watcher
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// array aggregates understood by -arrays
+var arrayAggregates = []string{"len", "sum", "min", "max", "avg"}
+
+// arrayMode is how one array column is expanded: one series per element
+// (with an index label) and/or aggregates over the elements
+type arrayMode struct {
+	elements bool
+	aggs     []string
+}
+
+// annotateArrays handles the arrays annotation
+func annotateArrays(q *queryDef, _, value string) error {
+	modes, err := parseArrayModes(value)
+	if err != nil {
+		return err
+	}
+	q.arrays = modes
+	return nil
+}
+
+// parseArrayModes parses "col=elements, col2=len|sum|max"
+func parseArrayModes(s string) (map[string]arrayMode, error) {
+	pairs, err := parseKeyValueList(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid arrays %q: %w", s, err)
+	}
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+	modes := make(map[string]arrayMode, len(pairs))
+	for col, spec := range pairs {
+		var m arrayMode
+		for _, it := range strings.Split(spec, "|") {
+			it = strings.ToLower(strings.TrimSpace(it))
+			switch {
+			case it == "elements":
+				m.elements = true
+			case slices.Contains(arrayAggregates, it):
+				m.aggs = append(m.aggs, it)
+			default:
+				return nil, fmt.Errorf("invalid array mode %q for column %s: want elements or %s", it, col, strings.Join(arrayAggregates, ", "))
+			}
+		}
+		modes[col] = m
+	}
+	return modes, nil
+}
+
+// arrayModeOf returns the expansion of an array column; annotations replace -arrays
+func (q queryDef) arrayModeOf(column string) (arrayMode, bool) {
+	modes := flagParam.arrays
+	if q.arrays != nil {
+		modes = q.arrays
+	}
+	m, ok := modes[column]
+	return m, ok
+}
+
+// flattenArray returns the elements of an array value in storage order;
+// multi-dimensional arrays are flattened
+func flattenArray(v any) ([]any, bool) {
+	rv := reflect.ValueOf(v)
+	if !rv.IsValid() || rv.Kind() != reflect.Slice || rv.Type().Elem().Kind() == reflect.Uint8 {
+		return nil, false // not an array; []byte is text
+	}
+	var elems []any
+	for i := 0; i < rv.Len(); i++ {
+		el := rv.Index(i).Interface()
+		if nested, ok := flattenArray(el); ok {
+			elems = append(elems, nested...)
+			continue
+		}
+		elems = append(elems, el)
+	}
+	return elems, true
+}
+
+// arrayElement is one sample derived from an array column
+type arrayElement struct {
+	suffix string  // _len, _sum, ... for aggregates, "" for elements
+	labels []label // index (and text value) labels of an element
+	value  float64
+}
+
+// expandArray turns an array column into element and aggregate samples. Elements are
+// numbered from 1 like PostgreSQL arrays; text elements become a label with value 1.
+// NULL elements are skipped and only count towards len.
+func expandArray(column string, m arrayMode, elems []any) []arrayElement {
+	var res []arrayElement
+	var nums []float64
+	for i, el := range elems {
+		if el == nil {
+			continue
+		}
+		f, ok := toFloat64(el)
+		if ok && (math.IsNaN(f) || math.IsInf(f, 0)) {
+			continue
+		}
+		if ok {
+			nums = append(nums, f)
+		}
+		if !m.elements {
+			continue
+		}
+		idx := label{name: "index", value: strconv.Itoa(i + 1)}
+		if ok {
+			res = append(res, arrayElement{labels: []label{idx}, value: f})
+		} else {
+			res = append(res, arrayElement{labels: []label{idx, {name: normalizeName(column), value: labelVal(el)}}, value: 1})
+		}
+	}
+
+	for _, agg := range m.aggs {
+		if agg == "len" {
+			res = append(res, arrayElement{suffix: "_len", value: float64(len(elems))})
+			continue
+		}
+		if len(nums) == 0 {
+			continue
+		}
+		v := nums[0]
+		switch agg {
+		case "sum", "avg":
+			v = 0
+			for _, n := range nums {
+				v += n
+			}
+			if agg == "avg" {
+				v /= float64(len(nums))
+			}
+		case "min":
+			for _, n := range nums {
+				v = math.Min(v, n)
+			}
+		case "max":
+			for _, n := range nums {
+				v = math.Max(v, n)
+			}
+		}
+		res = append(res, arrayElement{suffix: "_" + agg, value: v})
+	}
+	return res
+}
@@ -0,0 +1,69 @@
+package watcher
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseArrayModes(t *testing.T) {
+	modes, err := parseArrayModes("blks=elements, waits=len|sum|max")
+	if err != nil {
+		t.Fatalf("parseArrayModes() error = %v", err)
+	}
+	want := map[string]arrayMode{"blks": {elements: true}, "waits": {aggs: []string{"len", "sum", "max"}}}
+	if !reflect.DeepEqual(modes, want) {
+		t.Errorf("parseArrayModes() = %+v, want %+v", modes, want)
+	}
+	for _, bad := range []string{"blks=median", "blks"} {
+		if _, err := parseArrayModes(bad); err == nil {
+			t.Errorf("parseArrayModes(%q) expected error", bad)
+		}
+	}
+
+	flagParam = FlagParam{arrays: modes}
+	if _, ok := (queryDef{}).arrayModeOf("waits"); !ok {
+		t.Error("plain query did not inherit -arrays")
+	}
+	q, err := parseQueryDef("-- arrays: roles=elements\nselect 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := q.arrayModeOf("waits"); ok {
+		t.Error("arrays annotation did not replace -arrays")
+	}
+}
+
+// Test element and aggregate expansion of array values
+func TestExpandArray(t *testing.T) {
+	elems, ok := flattenArray([]any{int64(3), nil, int64(7)})
+	if !ok {
+		t.Fatal("flattenArray() rejected []any")
+	}
+	got := expandArray("blks", arrayMode{elements: true, aggs: []string{"len", "sum", "min", "max", "avg"}}, elems)
+	want := []arrayElement{
+		{labels: []label{{"index", "1"}}, value: 3},
+		{labels: []label{{"index", "3"}}, value: 7},
+		{suffix: "_len", value: 3},
+		{suffix: "_sum", value: 10},
+		{suffix: "_min", value: 3},
+		{suffix: "_max", value: 7},
+		{suffix: "_avg", value: 5},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expandArray() = %+v, want %+v", got, want)
+	}
+
+	// text elements become labels; nested arrays are flattened
+	elems, _ = flattenArray([]any{[]any{"pg_monitor"}, []any{"pg_read_all_stats"}})
+	got = expandArray("roles", arrayMode{elements: true}, elems)
+	if len(got) != 2 || got[1].value != 1 || got[1].labels[1] != (label{"roles", "pg_read_all_stats"}) {
+		t.Errorf("text elements = %+v", got)
+	}
+
+	if _, ok := flattenArray([]byte("text")); ok {
+		t.Error("flattenArray() accepted []byte")
+	}
+	if _, ok := flattenArray(nil); ok {
+		t.Error("flattenArray() accepted NULL")
+	}
+}
@@ -0,0 +1,237 @@
+package watcher
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+const (
+	overflowHash     = "hash"
+	overflowTruncate = "truncate"
+)
+
+// runSeries counts the series written in the current run against -max-series
+var runSeries atomic.Int64
+
+// seriesLimit returns the per-query series limit; the annotation replaces -max-series-per-query
+func (q queryDef) seriesLimit() int {
+	if q.maxSeries > 0 {
+		return q.maxSeries
+	}
+	return flagParam.maxQuerySeries
+}
+
+// labelLimit returns the maximum label value length in characters
+func (q queryDef) labelLimit() int {
+	if q.maxLabelLength > 0 {
+		return q.maxLabelLength
+	}
+	return flagParam.maxLabelLength
+}
+
+func (q queryDef) hasLimits() bool {
+	return q.seriesLimit() > 0 || q.labelLimit() > 0 || flagParam.maxSeries > 0
+}
+
+// limitCardinality shortens long label values and drops series beyond the per-query
+// and run-wide limits. When a limit is configured it appends the
+// <prefix>_series_dropped and <prefix>_label_values_shortened self-metrics,
+// and logs a warning when a limit was hit.
+func limitCardinality(dbname string, q queryDef, samples []sample) []sample {
+	if !q.hasLimits() {
+		return samples
+	}
+	maxLen, perQuery := q.labelLimit(), q.seriesLimit()
+	shortened, dropped, series := 0, 0, 0
+	kept := make(map[string]bool)
+	res := samples[:0:0]
+	for i := range samples {
+		s := samples[i]
+		if maxLen > 0 {
+			var n int
+			s.labels, n = shortenLabels(s.labels, maxLen)
+			shortened += n
+		}
+		key := limitKey(&s)
+		keep, ok := kept[key]
+		if !ok {
+			switch {
+			case perQuery > 0 && series >= perQuery:
+			case flagParam.maxSeries > 0 && runSeries.Add(1) > int64(flagParam.maxSeries):
+			default:
+				keep = true
+				series++
+			}
+			if !keep {
+				dropped++
+			}
+			kept[key] = keep
+		}
+		if keep {
+			res = append(res, s)
+		}
+	}
+
+	if dropped > 0 {
+		log.Printf("WARN: query %s in %s: dropped %d series over the series limit (per query %d, per run %d)",
+			q.displayName(), dbname, dropped, perQuery, flagParam.maxSeries)
+	}
+	if shortened > 0 {
+		log.Printf("WARN: query %s in %s: shortened %d label values longer than %d characters",
+			q.displayName(), dbname, shortened, maxLen)
+	}
+	return append(res,
+		limitSample(dbname, q, "series_dropped", float64(dropped), "Series dropped by cardinality limits"),
+		limitSample(dbname, q, "label_values_shortened", float64(shortened), "Label values shortened by -max-label-length"),
+	)
+}
+
+// limitCachedSeries counts a result served from cache against -max-series, so
+// cached and fresh results share the run-wide budget. Series over the budget are
+// dropped and added to the cached series_dropped self-metric.
+func limitCachedSeries(dbname string, q queryDef, samples []sample) []sample {
+	if flagParam.maxSeries <= 0 {
+		return samples
+	}
+	dropped := 0
+	kept := make(map[string]bool)
+	res := samples[:0:0]
+	for i := range samples {
+		s := samples[i]
+		if isSelfMetric(&s) {
+			res = append(res, s)
+			continue
+		}
+		key := limitKey(&s)
+		keep, ok := kept[key]
+		if !ok {
+			keep = runSeries.Add(1) <= int64(flagParam.maxSeries)
+			if !keep {
+				dropped++
+			}
+			kept[key] = keep
+		}
+		if keep {
+			res = append(res, s)
+		}
+	}
+	if dropped > 0 {
+		log.Printf("WARN: query %s in %s: dropped %d cached series over the series limit (per run %d)",
+			q.displayName(), dbname, dropped, flagParam.maxSeries)
+		for i := range res {
+			if isSelfMetric(&res[i]) && res[i].column == "series_dropped" {
+				res[i].value += float64(dropped)
+			}
+		}
+	}
+	return res
+}
+
+// limitKey identifies a series for the cardinality limits. All parts of a
+// histogram or summary (buckets, quantiles, _sum and _count) share one key, so
+// a distribution is kept or dropped as a whole and counts as one series.
+func limitKey(s *sample) string {
+	if s.family == "" {
+		return seriesKey(s)
+	}
+	var b strings.Builder
+	b.WriteString(stateDB(s.db))
+	b.WriteByte('|')
+	b.WriteString(s.family)
+	for _, l := range s.labels {
+		if (s.kind == kindHistogram && l.name == "le") || (s.kind == kindSummary && l.name == "quantile") {
+			continue
+		}
+		b.WriteByte('|')
+		b.WriteString(l.name)
+		b.WriteByte('=')
+		b.WriteString(l.value)
+	}
+	return b.String()
+}
+
+// isSelfMetric tells the series_dropped, label_values_shortened and
+// cache_age_seconds samples pg_watcher adds to a result; they do not count as series
+func isSelfMetric(s *sample) bool {
+	if s.prefix != flagParam.prefixMetric {
+		return false
+	}
+	switch s.column {
+	case "series_dropped", "label_values_shortened", "cache_age_seconds":
+		return len(s.labels) == 1 && s.labels[0].name == "query"
+	}
+	return false
+}
+
+func limitSample(dbname string, q queryDef, column string, value float64, help string) sample {
+	return sample{
+		name:   normalizeName(prefixedName(column)),
+		prefix: flagParam.prefixMetric,
+		column: column,
+		db:     dbname,
+		labels: []label{{name: "query", value: q.displayName()}},
+		value:  value,
+		help:   help,
+	}
+}
+
+// shortenLabels returns labels with values longer than maxLen characters shortened
+// according to -label-overflow; the input slice is shared by a row and is not modified
+func shortenLabels(labels []label, maxLen int) ([]label, int) {
+	var res []label
+	n := 0
+	for i, l := range labels {
+		if utf8.RuneCountInString(l.value) <= maxLen {
+			continue
+		}
+		if res == nil {
+			res = append([]label(nil), labels...)
+		}
+		res[i].value = shortenValue(l.value, maxLen)
+		n++
+	}
+	if res == nil {
+		return labels, 0
+	}
+	return res, n
+}
+
+// shortenValue cuts v to maxLen characters. In hash mode the tail is replaced by
+// "~" and a hash of the full value, so distinct long values stay distinct series.
+func shortenValue(v string, maxLen int) string {
+	if flagParam.labelOverflow == overflowTruncate {
+		return cutRunes(v, maxLen)
+	}
+	sum := sha256.Sum256([]byte(v))
+	h := hex.EncodeToString(sum[:4])
+	if maxLen <= len(h)+1 {
+		return h[:maxLen]
+	}
+	return cutRunes(v, maxLen-len(h)-1) + "~" + h
+}
+
+func cutRunes(s string, n int) string {
+	i := 0
+	for pos := range s {
+		if i == n {
+			return s[:pos]
+		}
+		i++
+	}
+	return s
+}
+
+// parseLabelOverflow validates -label-overflow
+func parseLabelOverflow(s string) (string, error) {
+	switch v := strings.ToLower(strings.TrimSpace(s)); v {
+	case overflowHash, overflowTruncate:
+		return v, nil
+	default:
+		return "", fmt.Errorf("invalid -label-overflow %q: want hash or truncate", s)
+	}
+}
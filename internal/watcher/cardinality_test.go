@@ -0,0 +1,135 @@
+package watcher
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func rowsOf(n int) []sample {
+	var samples []sample
+	for i := 0; i < n; i++ {
+		lbl := []label{{"relname", strings.Repeat("t", i+1)}}
+		samples = append(samples,
+			sample{name: "pgwatch_size", column: "size", db: "db", labels: lbl, value: float64(i)},
+			sample{name: "pgwatch_rows", column: "rows", db: "db", labels: lbl, value: float64(i)})
+	}
+	return samples
+}
+
+// Test dropping series over the per-query and per-run limits
+func TestLimitCardinality(t *testing.T) {
+	flagParam = FlagParam{prefixMetric: "pgwatch", labelOverflow: overflowHash}
+	runSeries.Store(0)
+
+	if got := limitCardinality("db", queryDef{}, rowsOf(3)); len(got) != 6 {
+		t.Errorf("no limits: got %d samples, want 6 without self-metrics", len(got))
+	}
+
+	q := queryDef{name: "sizes", maxSeries: 3}
+	got := limitCardinality("db", q, rowsOf(3))
+	if len(got) != 5 {
+		t.Fatalf("per-query limit: got %+v", got)
+	}
+	dropped := got[3]
+	if dropped.name != "pgwatch_series_dropped" || dropped.value != 3 || dropped.labels[0].value != "sizes" {
+		t.Errorf("series_dropped = %+v", dropped)
+	}
+
+	// the run-wide budget is shared by all queries and databases
+	flagParam.maxSeries = 5
+	limitCardinality("db1", queryDef{}, rowsOf(2))
+	got = limitCardinality("db2", queryDef{}, rowsOf(2))
+	if len(got) != 3 || got[1].value != 3 {
+		t.Errorf("per-run limit: got %+v", got)
+	}
+}
+
+// Test that a histogram is kept or dropped as a whole and counts as one series
+func TestLimitCardinalityHistogram(t *testing.T) {
+	flagParam = FlagParam{prefixMetric: "pgwatch"}
+	runSeries.Store(0)
+	q := histogramQuery(t, "-- name: lat\n-- histogram: le, n, total\n-- max_series: 2\nselect 1")
+	var rows []distRow
+	for _, db := range []string{"app", "web", "etl"} {
+		lbl := []label{{"datname", db}}
+		rows = append(rows,
+			distRow{labels: lbl, vals: map[string]any{"le": 0.1, "n": 1.0, "total": 0.1}},
+			distRow{labels: lbl, vals: map[string]any{"le": 1.0, "n": 1.0, "total": 0.5}},
+			distRow{labels: lbl, vals: map[string]any{"le": nil, "n": 1.0, "total": 2.0}})
+	}
+	samples := synthesizeDistribution(q, q.prefix(), "db", rows)
+
+	got := limitCardinality("db", q, samples)
+	parts := got[:len(got)-2]
+	if len(parts) != 10 {
+		t.Fatalf("limitCardinality() kept %d parts, want two complete histograms:\n%s", len(parts), promText(parts))
+	}
+	for _, s := range parts {
+		if s.labels[0].value == "etl" {
+			t.Errorf("part of the third histogram kept: %+v", s)
+		}
+	}
+	if dropped := got[len(got)-2]; dropped.value != 1 {
+		t.Errorf("series_dropped = %v, want 1", dropped.value)
+	}
+
+	// the cached result shares the run-wide budget the same way
+	flagParam.maxSeries = 3
+	runSeries.Store(2)
+	cached := limitCachedSeries("db", q, parts)
+	if len(cached) != 5 || cached[len(cached)-1].name != "pgwatch_lat_sum" {
+		t.Errorf("limitCachedSeries() =\n%s", promText(cached))
+	}
+}
+
+// Test shortening long label values
+func TestShortenLabels(t *testing.T) {
+	flagParam = FlagParam{labelOverflow: overflowHash}
+	long := strings.Repeat("ä", 40)
+	row := []label{{"query", long}, {"usename", "app"}}
+
+	got, n := shortenLabels(row, 20)
+	if n != 1 || utf8.RuneCountInString(got[0].value) != 20 || got[1].value != "app" {
+		t.Errorf("shortenLabels() = %v, %d", got, n)
+	}
+	if row[0].value != long {
+		t.Error("shortenLabels() modified the shared row labels")
+	}
+	other, _ := shortenLabels([]label{{"query", long + "x"}}, 20)
+	if other[0].value == got[0].value {
+		t.Error("hash mode merged distinct values")
+	}
+
+	flagParam.labelOverflow = overflowTruncate
+	if got, _ := shortenLabels(row, 5); got[0].value != "äääää" {
+		t.Errorf("truncate = %q", got[0].value)
+	}
+	if _, err := parseLabelOverflow("drop"); err == nil {
+		t.Error("parseLabelOverflow(drop) expected error")
+	}
+}
+
+// Test that results served from cache use the same run-wide budget
+func TestLimitCachedSeries(t *testing.T) {
+	flagParam = FlagParam{prefixMetric: "pgwatch", maxSeries: 5}
+	runSeries.Store(0)
+	q := queryDef{name: "sizes"}
+	fresh := limitCardinality("db1", q, rowsOf(2))
+	cached := append(rowsOf(2), fresh[len(fresh)-2:]...)
+	got := limitCachedSeries("db2", q, cached)
+	if len(got) != 3 {
+		t.Fatalf("limitCachedSeries() = %+v", got)
+	}
+	if got[1].column != "series_dropped" || got[1].value != 3 {
+		t.Errorf("series_dropped = %+v", got[1])
+	}
+	if runSeries.Load() != 8 {
+		t.Errorf("runSeries = %d", runSeries.Load())
+	}
+
+	flagParam.maxSeries = 0
+	if got := limitCachedSeries("db2", q, cached); len(got) != len(cached) {
+		t.Errorf("no limit: got %d samples, want %d", len(got), len(cached))
+	}
+}
@@ -0,0 +1,185 @@
+package watcher
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// transformKind turns a cumulative column into a value relative to the previous run
+type transformKind int
+
+const (
+	transformNone transformKind = iota
+	transformDelta
+	transformRate
+)
+
+// maxPreviousAge drops remembered values of series that stopped reporting
+const maxPreviousAge = 24 * time.Hour
+
+// prevValue is the last observation of a transformed series
+type prevValue struct {
+	Value float64   `json:"v"`
+	At    time.Time `json:"at"`
+	// Mark is the reset column value and postmaster start time at observation
+	Mark string `json:"mark,omitempty"`
+}
+
+// transformOf returns the delta/rate setting of a column; annotations replace -delta / -rate
+func (q queryDef) transformOf(column string) transformKind {
+	if q.transforms != nil {
+		return q.transforms[column]
+	}
+	switch {
+	case flagParam.deltaColumns[column]:
+		return transformDelta
+	case flagParam.rateColumns[column]:
+		return transformRate
+	}
+	return transformNone
+}
+
+func (q queryDef) hasTransforms() bool {
+	if q.transforms != nil {
+		return len(q.transforms) > 0
+	}
+	return len(flagParam.deltaColumns) > 0 || len(flagParam.rateColumns) > 0
+}
+
+// resetColumnName is the column consumed as counter reset marker, "" if none
+func (q queryDef) resetColumnName() string {
+	if q.resetColumn != "" {
+		return q.resetColumn
+	}
+	return flagParam.resetColumn
+}
+
+// resetMarker renders a reset column value (usually a stats_reset timestamp)
+func resetMarker(v any) string {
+	if v == nil {
+		return ""
+	}
+	if t, ok := v.(time.Time); ok {
+		return t.UTC().Format(time.RFC3339Nano)
+	}
+	return fmt.Sprint(v)
+}
+
+// serverStartTime returns pg_postmaster_start_time(); a restart resets every counter.
+// Errors only weaken reset detection, so they are logged and reported as unknown
+// (ok = false); admin consoles have no start time and always yield "".
+func serverStartTime(ctxParent context.Context, conn *pgx.Conn) (string, bool) {
+	if flagParam.pooler != "" {
+		return "", true
+	}
+	ctx, cancel := context.WithTimeout(ctxParent, flagParam.pgTimeout)
+	defer cancel()
+	var started time.Time
+	if err := conn.QueryRow(ctx, "SELECT pg_postmaster_start_time()").Scan(&started); err != nil {
+		log.Printf("WARN: pg_postmaster_start_time: %v", err)
+		return "", false
+	}
+	return resetMarker(started), true
+}
+
+// seriesKey identifies one transformed series across runs
+func seriesKey(s *sample) string {
+	var b strings.Builder
+	b.WriteString(stateDB(s.db))
+	b.WriteByte('|')
+	b.WriteString(s.name)
+	for _, l := range s.labels {
+		b.WriteByte('|')
+		b.WriteString(l.name)
+		b.WriteByte('=')
+		b.WriteString(l.value)
+	}
+	return b.String()
+}
+
+// applyTransforms replaces delta/rate columns by the difference to the previous
+// observation: <name>_delta or <name>_per_second. The first observation of a series
+// only primes the state. A changed reset marker, a new postmaster start time or a
+// decreasing value count as a reset, after which the current value is the delta.
+// An unknown start time (startKnown false) keeps the one of the previous observation.
+func (st *stateStore) applyTransforms(dbname string, q queryDef, samples []sample, serverStart string, startKnown bool) []sample {
+	now := time.Now()
+	res := samples[:0:0]
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for i := range samples {
+		s := samples[i]
+		kind := q.transformOf(s.column)
+		if kind == transformNone {
+			res = append(res, s)
+			continue
+		}
+		at := s.ts
+		if at.IsZero() {
+			at = now
+		}
+		if st.data.Previous == nil {
+			st.data.Previous = make(map[string]*prevValue)
+		}
+		key := seriesKey(&s)
+		prev, ok := st.data.Previous[key]
+		start := serverStart
+		if !startKnown && ok {
+			start = markStart(prev.Mark)
+		}
+		cur := &prevValue{Value: s.value, At: at, Mark: s.resetMark + "|" + start}
+		st.data.Previous[key] = cur
+		if !ok {
+			continue
+		}
+
+		delta := cur.Value - prev.Value
+		if marksDiffer(prev.Mark, cur.Mark) || delta < 0 {
+			delta = cur.Value
+		}
+		s.kind, s.unit = kindGauge, ""
+		switch kind {
+		case transformDelta:
+			s.name, s.column = s.name+"_delta", s.column+"_delta"
+			s.value = delta
+		case transformRate:
+			elapsed := cur.At.Sub(prev.At).Seconds()
+			if elapsed <= 0 {
+				continue
+			}
+			s.name, s.column = s.name+"_per_second", s.column+"_per_second"
+			s.value = delta / elapsed
+		}
+		res = append(res, s)
+	}
+	return res
+}
+
+// markStart returns the postmaster start time part of a reset mark
+func markStart(mark string) string {
+	return mark[strings.LastIndexByte(mark, '|')+1:]
+}
+
+// marksDiffer reports a reset between two marks; an empty start time was unknown
+// when the mark was taken and matches any other
+func marksDiffer(prev, cur string) bool {
+	prevStart, curStart := markStart(prev), markStart(cur)
+	if prev[:len(prev)-len(prevStart)] != cur[:len(cur)-len(curStart)] {
+		return true
+	}
+	return prevStart != "" && curStart != "" && prevStart != curStart
+}
+
+// prunePrevious forgets series not seen for maxPreviousAge; st.mu must be held
+func (st *stateStore) prunePrevious(now time.Time) {
+	for k, p := range st.data.Previous {
+		if now.Sub(p.At) > maxPreviousAge {
+			delete(st.data.Previous, k)
+		}
+	}
+}
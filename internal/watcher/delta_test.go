@@ -0,0 +1,104 @@
+package watcher
+
+import (
+	"testing"
+	"time"
+)
+
+// Test delta and rate output across runs, including counter resets
+func TestApplyTransforms(t *testing.T) {
+	flagParam = FlagParam{prefixMetric: "pgwatch"}
+	persist = &stateStore{}
+	q := queryDef{transforms: map[string]transformKind{"xact_commit": transformDelta, "blks_read": transformRate}}
+	t0 := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	run := func(ts time.Time, commits, reads float64, mark, start string) []sample {
+		lbl := []label{{"datname", "app"}}
+		return persist.applyTransforms("db", q, []sample{
+			{name: "pgwatch_xact_commit", column: "xact_commit", db: "db", labels: lbl, value: commits, kind: kindCounter, ts: ts, resetMark: mark},
+			{name: "pgwatch_blks_read", column: "blks_read", db: "db", labels: lbl, value: reads, ts: ts, resetMark: mark},
+			{name: "pgwatch_numbackends", column: "numbackends", db: "db", labels: lbl, value: 3, ts: ts, resetMark: mark},
+		}, start, start != "")
+	}
+
+	// the first run only primes the state
+	if got := run(t0, 100, 1000, "r1", "s1"); len(got) != 1 || got[0].name != "pgwatch_numbackends" {
+		t.Fatalf("first run = %+v", got)
+	}
+
+	got := run(t0.Add(10*time.Second), 150, 3000, "r1", "s1")
+	if len(got) != 3 {
+		t.Fatalf("second run = %+v", got)
+	}
+	if got[0].name != "pgwatch_xact_commit_delta" || got[0].value != 50 || got[0].kind != kindGauge {
+		t.Errorf("delta = %+v", got[0])
+	}
+	if got[1].name != "pgwatch_blks_read_per_second" || got[1].value != 200 {
+		t.Errorf("rate = %+v", got[1])
+	}
+
+	// a decreasing counter restarted from zero
+	got = run(t0.Add(20*time.Second), 20, 3500, "r1", "s1")
+	if got[0].value != 20 || got[1].value != 50 {
+		t.Errorf("after decrease = %v, %v", got[0].value, got[1].value)
+	}
+
+	// pg_stat_reset() or a restart changes the marker even if values grew
+	got = run(t0.Add(30*time.Second), 40, 4000, "r2", "s1")
+	if got[0].value != 40 || got[1].value != 400 {
+		t.Errorf("after stats_reset = %v, %v", got[0].value, got[1].value)
+	}
+	got = run(t0.Add(40*time.Second), 50, 4100, "r2", "s2")
+	if got[0].value != 50 {
+		t.Errorf("after restart = %v", got[0].value)
+	}
+
+	// a failed pg_postmaster_start_time() is no reset, neither is its recovery
+	got = run(t0.Add(50*time.Second), 60, 4200, "r2", "")
+	if got[0].value != 10 {
+		t.Errorf("with unknown start time = %v", got[0].value)
+	}
+	got = run(t0.Add(60*time.Second), 70, 4300, "r2", "s2")
+	if got[0].value != 10 {
+		t.Errorf("after start time is known again = %v", got[0].value)
+	}
+	// a restart while the start time was unknown is still detected later
+	run(t0.Add(70*time.Second), 80, 4400, "r2", "")
+	got = run(t0.Add(80*time.Second), 90, 4500, "r2", "s3")
+	if got[0].value != 90 {
+		t.Errorf("restart after unknown start time = %v", got[0].value)
+	}
+
+	// a series first seen without a start time is not reset once it is known
+	persist = &stateStore{}
+	run(t0, 100, 1000, "r1", "")
+	if got = run(t0.Add(10*time.Second), 110, 1100, "r1", "s1"); got[0].value != 10 {
+		t.Errorf("primed without start time = %v", got[0].value)
+	}
+
+	// stale series are forgotten
+	persist.prunePrevious(t0.Add(10*time.Second + maxPreviousAge + time.Second))
+	if len(persist.data.Previous) != 0 {
+		t.Errorf("prunePrevious() kept %v", persist.data.Previous)
+	}
+}
+
+// Test fallback from annotations to -delta / -rate / -reset-column
+func TestTransformDefaults(t *testing.T) {
+	flagParam = FlagParam{deltaColumns: map[string]bool{"calls": true}, rateColumns: map[string]bool{"rows": true}, resetColumn: "stats_reset"}
+
+	plain := queryDef{}
+	if !plain.hasTransforms() || plain.transformOf("calls") != transformDelta || plain.transformOf("rows") != transformRate {
+		t.Errorf("plain query did not inherit flags")
+	}
+	if plain.resetColumnName() != "stats_reset" {
+		t.Errorf("resetColumnName() = %q", plain.resetColumnName())
+	}
+
+	q, err := parseQueryDef("-- rate: calls\n-- reset_column: reset_at\nselect 1")
+	if err != nil {
+		t.Fatalf("parseQueryDef() error = %v", err)
+	}
+	if q.transformOf("calls") != transformRate || q.transformOf("rows") != transformNone || q.resetColumnName() != "reset_at" {
+		t.Errorf("annotations did not override flags: %+v", q)
+	}
+}
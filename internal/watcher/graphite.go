@@ -0,0 +1,153 @@
+package watcher
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	formatGraphite = "graphite"
+	formatStatsD   = "statsd"
+
+	outputDialTimeout = 10 * time.Second
+	// maxUDPPayload keeps StatsD datagrams below a typical Ethernet MTU
+	maxUDPPayload = 1432
+)
+
+// lineSink renders samples line by line and writes them to stdout or a TCP/UDP socket
+type lineSink struct {
+	mu     sync.Mutex
+	w      io.Writer
+	conn   net.Conn
+	udp    bool
+	render func(b *strings.Builder, s *sample, now time.Time)
+}
+
+// newLineSink connects to -output-addr (or uses stdout when empty).
+// A bare host:port defaults to TCP for Graphite and UDP for StatsD.
+func newLineSink(format string) (*lineSink, error) {
+	ls := &lineSink{w: stdout, render: renderGraphite}
+	defaultNetwork := "tcp"
+	if format == formatStatsD {
+		ls.render = renderStatsD
+		defaultNetwork = "udp"
+	}
+	if flagParam.outputAddr == "" {
+		return ls, nil
+	}
+
+	network, addr := defaultNetwork, flagParam.outputAddr
+	if scheme, rest, ok := strings.Cut(addr, "://"); ok {
+		network, addr = scheme, rest
+	}
+	if network != "tcp" && network != "udp" {
+		return nil, fmt.Errorf("unsupported -output-addr network %q (use tcp:// or udp://)", network)
+	}
+	conn, err := net.DialTimeout(network, addr, outputDialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("connect %s output %s: %w", format, flagParam.outputAddr, err)
+	}
+	ls.w, ls.conn, ls.udp = conn, conn, network == "udp"
+	return ls, nil
+}
+
+func (l *lineSink) write(samples []sample) error {
+	now := time.Now()
+	var lines []string
+	for i := range samples {
+		var b strings.Builder
+		l.render(&b, &samples[i], now)
+		lines = append(lines, b.String())
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.udp {
+		_, err := io.WriteString(l.w, strings.Join(lines, ""))
+		return err
+	}
+	// one datagram per batch of whole lines
+	var pkt strings.Builder
+	for _, line := range lines {
+		if pkt.Len() > 0 && pkt.Len()+len(line) > maxUDPPayload {
+			if _, err := io.WriteString(l.w, pkt.String()); err != nil {
+				return err
+			}
+			pkt.Reset()
+		}
+		pkt.WriteString(line)
+	}
+	if pkt.Len() > 0 {
+		_, err := io.WriteString(l.w, pkt.String())
+		return err
+	}
+	return nil
+}
+
+func (l *lineSink) close() error {
+	if l.conn != nil {
+		return l.conn.Close()
+	}
+	return nil
+}
+
+// graphitePath builds <prefix>.<db>.<label values...>.<column>
+func graphitePath(s *sample) string {
+	parts := make([]string, 0, len(s.labels)+3)
+	for _, p := range strings.Split(s.prefix, ".") {
+		if p != "" {
+			parts = append(parts, sanitizeGraphite(p))
+		}
+	}
+	parts = append(parts, sanitizeGraphite(s.db))
+	for _, l := range s.labels {
+		parts = append(parts, sanitizeGraphite(l.value))
+	}
+	parts = append(parts, sanitizeGraphite(normalizeName(s.column)))
+	return strings.Join(parts, ".")
+}
+
+// sanitizeGraphite makes a value safe to use as one path node: dots, spaces and
+// other separators become underscores and empty values become "none"
+func sanitizeGraphite(s string) string {
+	if s == "" {
+		return "none"
+	}
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '-':
+			b.WriteRune(r)
+		default:
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
+
+// renderGraphite emits the plaintext protocol: path value timestamp
+func renderGraphite(b *strings.Builder, s *sample, now time.Time) {
+	if !s.ts.IsZero() {
+		now = s.ts
+	}
+	fmt.Fprintf(b, "%s %s %d\n", graphitePath(s), formatFloat(s.value), now.Unix())
+}
+
+// renderStatsD emits a gauge; negative values are preceded by a reset to 0
+// because StatsD reads a signed gauge value as a delta
+func renderStatsD(b *strings.Builder, s *sample, _ time.Time) {
+	path := graphitePath(s)
+	if s.value < 0 {
+		fmt.Fprintf(b, "%s:0|g\n", path)
+	}
+	fmt.Fprintf(b, "%s:%s|g\n", path, formatFloat(s.value))
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
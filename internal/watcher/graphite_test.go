@@ -0,0 +1,87 @@
+package watcher
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test Graphite path construction and sanitization
+func TestGraphitePath(t *testing.T) {
+	tests := []struct {
+		name     string
+		s        sample
+		expected string
+	}{
+		{
+			"no labels",
+			sample{prefix: "pgwatch", db: "postgres", column: "numbackends"},
+			"pgwatch.postgres.numbackends",
+		},
+		{
+			"dots in label values",
+			sample{prefix: "pgwatch", db: "app", column: "n_live_tup", labels: []label{{"schema", "public"}, {"table", "my.table"}}},
+			"pgwatch.app.public.my_table.n_live_tup",
+		},
+		{
+			"dotted prefix and empty label",
+			sample{prefix: "pg.prod", db: "my db", column: "Size-Bytes", labels: []label{{"user", ""}}},
+			"pg.prod.my_db.none.size_bytes",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := graphitePath(&tt.s); got != tt.expected {
+				t.Errorf("graphitePath() = %q, want %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+// Test plaintext and StatsD line rendering
+func TestRenderGraphiteStatsD(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	s := sample{prefix: "pgwatch", db: "db", column: "lag", value: -2.5}
+
+	var b strings.Builder
+	renderGraphite(&b, &s, now)
+	if got := b.String(); got != "pgwatch.db.lag -2.5 1700000000\n" {
+		t.Errorf("renderGraphite() = %q", got)
+	}
+
+	b.Reset()
+	renderStatsD(&b, &s, now)
+	if got := b.String(); got != "pgwatch.db.lag:0|g\npgwatch.db.lag:-2.5|g\n" {
+		t.Errorf("renderStatsD() = %q", got)
+	}
+}
+
+// Test StatsD over UDP against a local listener
+func TestLineSinkUDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer pc.Close()
+
+	flagParam = FlagParam{outputAddr: "udp://" + pc.LocalAddr().String()}
+	ls, err := newLineSink(formatStatsD)
+	if err != nil {
+		t.Fatalf("newLineSink() error = %v", err)
+	}
+	defer ls.close()
+	if err := ls.write([]sample{{prefix: "pgwatch", db: "db", column: "calls", value: 7}}); err != nil {
+		t.Fatalf("write() error = %v", err)
+	}
+
+	buf := make([]byte, maxUDPPayload)
+	_ = pc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if got := string(buf[:n]); got != "pgwatch.db.calls:7|g\n" {
+		t.Errorf("datagram = %q", got)
+	}
+}
@@ -0,0 +1,282 @@
+package watcher
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// histogramSpec builds a Prometheus histogram from one row per bucket: the upper
+// bound column (NULL or 'Infinity' for +Inf), the per-bucket count column and an
+// optional column with the sum of the bucket's observations
+type histogramSpec struct {
+	leColumn    string
+	countColumn string
+	sumColumn   string
+}
+
+// summarySpec builds a Prometheus summary from one row per series: quantile
+// columns plus optional count and sum columns
+type summarySpec struct {
+	quantiles   map[string]float64 // column → quantile
+	countColumn string
+	sumColumn   string
+}
+
+// parseHistogram parses "le_column, count_column[, sum_column]"
+func parseHistogram(s string) (*histogramSpec, error) {
+	cols := splitList(s)
+	if len(cols) < 2 || len(cols) > 3 {
+		return nil, fmt.Errorf("invalid histogram %q: want le_column, count_column[, sum_column]", s)
+	}
+	h := &histogramSpec{leColumn: cols[0], countColumn: cols[1]}
+	if len(cols) == 3 {
+		h.sumColumn = cols[2]
+	}
+	return h, nil
+}
+
+// parseSummary parses "p50=0.5, p99=0.99"
+func parseSummary(s string) (*summarySpec, error) {
+	pairs, err := parseKeyValueList(s)
+	if err != nil || len(pairs) == 0 {
+		return nil, fmt.Errorf("invalid summary %q: want column=quantile pairs like p50=0.5,p99=0.99", s)
+	}
+	sum := &summarySpec{quantiles: make(map[string]float64, len(pairs))}
+	for col, v := range pairs {
+		q, err := strconv.ParseFloat(v, 64)
+		if err != nil || q < 0 || q > 1 {
+			return nil, fmt.Errorf("invalid quantile %q for column %s: want a number between 0 and 1", v, col)
+		}
+		sum.quantiles[col] = q
+	}
+	return sum, nil
+}
+
+// annotateHistogram handles the histogram annotation
+func annotateHistogram(q *queryDef, _, value string) error {
+	h, err := parseHistogram(value)
+	if err != nil {
+		return err
+	}
+	q.histogram = h
+	return nil
+}
+
+// annotateSummary handles summary and the summary_count / summary_sum columns that follow it
+func annotateSummary(q *queryDef, key, value string) error {
+	if key == "summary" {
+		s, err := parseSummary(value)
+		if err != nil {
+			return err
+		}
+		if q.summary != nil {
+			s.countColumn, s.sumColumn = q.summary.countColumn, q.summary.sumColumn
+		}
+		q.summary = s
+		return nil
+	}
+	if q.summary == nil {
+		return fmt.Errorf("%s annotation needs a summary annotation before it", key)
+	}
+	if key == "summary_count" {
+		q.summary.countColumn = value
+	} else {
+		q.summary.sumColumn = value
+	}
+	return nil
+}
+
+// isDistColumn tells whether a column feeds the histogram or summary of the query
+func (q queryDef) isDistColumn(column string) bool {
+	if h := q.histogram; h != nil {
+		return column == h.leColumn || column == h.countColumn || (h.sumColumn != "" && column == h.sumColumn)
+	}
+	if s := q.summary; s != nil {
+		_, ok := s.quantiles[column]
+		return ok || (s.countColumn != "" && column == s.countColumn) || (s.sumColumn != "" && column == s.sumColumn)
+	}
+	return false
+}
+
+// distRow is one result row of a histogram or summary query
+type distRow struct {
+	labels []label
+	ts     time.Time
+	vals   map[string]any // distribution columns by name
+}
+
+// synthesizeDistribution turns the rows of a histogram or summary query into
+// <family>_bucket{le}/_sum/_count or <family>{quantile}/_sum/_count samples.
+// The family is the query prefix (set it with "-- name:"). Invalid series are
+// logged and skipped.
+func synthesizeDistribution(q queryDef, prefix, dbname string, rows []distRow) []sample {
+	family := normalizeName(prefix)
+	base := sample{prefix: prefix, family: family, db: dbname, unit: unitFor(q.name)}
+
+	if q.summary != nil {
+		var samples []sample
+		for _, r := range rows {
+			s, err := summarySamples(q.summary, base, r)
+			if err != nil {
+				log.Printf("WARN: [db=%s] summary %s%s skipped: %v", dbname, family, labelsString(r.labels), err)
+				continue
+			}
+			samples = append(samples, s...)
+		}
+		return samples
+	}
+
+	// one histogram per label set, buckets in row order
+	var order []string
+	groups := make(map[string][]distRow)
+	for _, r := range rows {
+		key := labelsString(r.labels)
+		if _, ok := groups[key]; !ok {
+			order = append(order, key)
+		}
+		groups[key] = append(groups[key], r)
+	}
+	var samples []sample
+	for _, key := range order {
+		s, err := histogramSamples(q.histogram, base, groups[key])
+		if err != nil {
+			log.Printf("WARN: [db=%s] histogram %s%s skipped: %v", dbname, family, key, err)
+			continue
+		}
+		samples = append(samples, s...)
+	}
+	return samples
+}
+
+func histogramSamples(h *histogramSpec, base sample, rows []distRow) ([]sample, error) {
+	base.kind = kindHistogram
+	base.labels, base.ts = rows[0].labels, rows[0].ts
+	var samples []sample
+	cum, sum := 0.0, 0.0
+	prev := math.Inf(-1)
+	for _, r := range rows {
+		le, ok := bucketBound(r.vals[h.leColumn])
+		if !ok {
+			return nil, fmt.Errorf("invalid bucket bound %v", r.vals[h.leColumn])
+		}
+		if le <= prev {
+			return nil, fmt.Errorf("bucket bounds are not increasing (%s after %s)", formatLe(le), formatLe(prev))
+		}
+		prev = le
+		n := 0.0
+		if v := r.vals[h.countColumn]; v != nil {
+			if n, ok = toFloat64(v); !ok || n < 0 || math.IsNaN(n) {
+				return nil, fmt.Errorf("invalid bucket count %v", v)
+			}
+		}
+		cum += n
+		if h.sumColumn != "" {
+			if f, ok := toFloat64(r.vals[h.sumColumn]); ok {
+				sum += f
+			}
+		}
+		samples = append(samples, bucketSample(base, le, cum))
+	}
+	if !math.IsInf(prev, 1) {
+		samples = append(samples, bucketSample(base, math.Inf(1), cum))
+	}
+	samples = append(samples, distPart(base, "_count", cum))
+	if h.sumColumn != "" {
+		samples = append(samples, distPart(base, "_sum", sum))
+	}
+	return samples, nil
+}
+
+func summarySamples(spec *summarySpec, base sample, r distRow) ([]sample, error) {
+	base.kind = kindSummary
+	base.labels, base.ts = r.labels, r.ts
+	cols := make([]string, 0, len(spec.quantiles))
+	for col := range spec.quantiles {
+		cols = append(cols, col)
+	}
+	sort.Slice(cols, func(i, j int) bool { return spec.quantiles[cols[i]] < spec.quantiles[cols[j]] })
+
+	var samples []sample
+	prev := math.Inf(-1)
+	for _, col := range cols {
+		v, ok := toFloat64(r.vals[col])
+		if !ok || math.IsNaN(v) {
+			continue // NULL quantile, e.g. no observations
+		}
+		if v < prev {
+			return nil, fmt.Errorf("quantile values are not monotonic (%s = %g)", col, v)
+		}
+		prev = v
+		s := distPart(base, "", v)
+		s.labels = append(append([]label(nil), base.labels...), label{name: "quantile", value: formatFloat(spec.quantiles[col])})
+		samples = append(samples, s)
+	}
+	if spec.countColumn != "" {
+		if v, ok := toFloat64(r.vals[spec.countColumn]); ok {
+			samples = append(samples, distPart(base, "_count", v))
+		}
+	}
+	if spec.sumColumn != "" {
+		if v, ok := toFloat64(r.vals[spec.sumColumn]); ok {
+			samples = append(samples, distPart(base, "_sum", v))
+		}
+	}
+	return samples, nil
+}
+
+func bucketSample(base sample, le, cum float64) sample {
+	s := distPart(base, "_bucket", cum)
+	s.labels = append(append([]label(nil), base.labels...), label{name: "le", value: formatLe(le)})
+	return s
+}
+
+// distPart is one sample of a distribution; suffix is _bucket, _sum, _count or ""
+// for a quantile. The suffix doubles as the column name used in Graphite paths.
+func distPart(base sample, suffix string, v float64) sample {
+	base.name = base.family + suffix
+	base.column = strings.TrimPrefix(suffix, "_")
+	if suffix == "" {
+		base.column = "quantile"
+	}
+	base.value = v
+	return base
+}
+
+// bucketBound reads an upper bound; NULL and infinity mean +Inf
+func bucketBound(v any) (float64, bool) {
+	if v == nil {
+		return math.Inf(1), true
+	}
+	if s, ok := v.(string); ok {
+		switch strings.ToLower(strings.TrimSpace(s)) {
+		case "+inf", "inf", "infinity":
+			return math.Inf(1), true
+		}
+	}
+	f, ok := toFloat64(v)
+	return f, ok && !math.IsNaN(f)
+}
+
+func formatLe(le float64) string {
+	if math.IsInf(le, 1) {
+		return "+Inf"
+	}
+	return formatFloat(le)
+}
+
+// labelsString renders a label set for grouping and log messages
+func labelsString(labels []label) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	parts := make([]string, len(labels))
+	for i, l := range labels {
+		parts[i] = fmt.Sprintf("%s=%q", l.name, l.value)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
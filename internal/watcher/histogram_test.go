@@ -0,0 +1,128 @@
+package watcher
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+)
+
+func histogramQuery(t *testing.T, text string) queryDef {
+	t.Helper()
+	q, err := parseQueryDef(text)
+	if err != nil {
+		t.Fatalf("parseQueryDef() error = %v", err)
+	}
+	return q
+}
+
+// Test histogram synthesis from per-bucket rows
+func TestSynthesizeHistogram(t *testing.T) {
+	flagParam = FlagParam{prefixMetric: "pgwatch"}
+	q := histogramQuery(t, "-- name: query_duration_seconds\n-- histogram: le, n, total\nselect 1")
+	app := []label{{"datname", "app"}}
+	rows := []distRow{
+		{labels: app, vals: map[string]any{"le": 0.1, "n": int64(5), "total": 0.2}},
+		{labels: app, vals: map[string]any{"le": 1.0, "n": int64(3), "total": 1.5}},
+		{labels: []label{{"datname", "bad"}}, vals: map[string]any{"le": 1.0, "n": int64(1)}},
+		{labels: []label{{"datname", "bad"}}, vals: map[string]any{"le": 0.5, "n": int64(1)}},
+		{labels: app, vals: map[string]any{"le": nil, "n": int64(2), "total": 10.0}},
+	}
+	got := promText(synthesizeDistribution(q, q.prefix(), "db", rows))
+	want := `pgwatch_query_duration_seconds_bucket{datname="app",le="0.1",db="db"} 5
+pgwatch_query_duration_seconds_bucket{datname="app",le="1",db="db"} 8
+pgwatch_query_duration_seconds_bucket{datname="app",le="+Inf",db="db"} 10
+pgwatch_query_duration_seconds_count{datname="app",db="db"} 10
+pgwatch_query_duration_seconds_sum{datname="app",db="db"} 11.7
+`
+	if got != want {
+		t.Errorf("histogram =\n%s\nwant\n%s", got, want)
+	}
+
+	// a missing +Inf bucket is added
+	q = histogramQuery(t, "-- name: size\n-- histogram: le, n\nselect 1")
+	samples := synthesizeDistribution(q, q.prefix(), "db", []distRow{{vals: map[string]any{"le": 10.0, "n": 4.0}}})
+	if len(samples) != 3 || samples[1].labels[0].value != "+Inf" || samples[1].value != 4 || samples[2].name != "pgwatch_size_count" {
+		t.Errorf("histogram without +Inf = %+v", samples)
+	}
+	if _, ok := bucketBound("Infinity"); !ok {
+		t.Error("bucketBound(Infinity) failed")
+	}
+	if le, _ := bucketBound(math.Inf(1)); !math.IsInf(le, 1) {
+		t.Error("bucketBound(+Inf) failed")
+	}
+}
+
+// Test summary synthesis from quantile columns
+func TestSynthesizeSummary(t *testing.T) {
+	flagParam = FlagParam{prefixMetric: "pgwatch"}
+	q := histogramQuery(t, "-- name: exec_time\n-- summary: p50=0.5, p99=0.99\n-- summary_count: calls\n-- summary_sum: total\nselect 1")
+	rows := []distRow{
+		{labels: []label{{"queryid", "1"}}, vals: map[string]any{"p50": 2.0, "p99": 9.0, "calls": int64(100), "total": 300.0}},
+		{labels: []label{{"queryid", "2"}}, vals: map[string]any{"p50": 5.0, "p99": 1.0, "calls": int64(1), "total": 1.0}},
+	}
+	got := promText(synthesizeDistribution(q, q.prefix(), "db", rows))
+	want := `pgwatch_exec_time{queryid="1",quantile="0.5",db="db"} 2
+pgwatch_exec_time{queryid="1",quantile="0.99",db="db"} 9
+pgwatch_exec_time_count{queryid="1",db="db"} 100
+pgwatch_exec_time_sum{queryid="1",db="db"} 300
+`
+	if got != want {
+		t.Errorf("summary =\n%s\nwant\n%s", got, want)
+	}
+
+	for _, bad := range []string{
+		"-- summary: p50=1.5\nselect 1",
+		"-- summary_count: calls\nselect 1",
+		"-- histogram: le\nselect 1",
+		"-- histogram: le, n\n-- pivot: name, setting\nselect 1",
+	} {
+		if _, err := parseQueryDef(bad); err == nil {
+			t.Errorf("parseQueryDef(%q) expected error", bad)
+		}
+	}
+}
+
+// Test histogram output in OpenMetrics and OTLP
+func TestHistogramOutputs(t *testing.T) {
+	flagParam = FlagParam{prefixMetric: "pgwatch"}
+	q := histogramQuery(t, "-- name: wait_seconds\n-- histogram: le, n, total\nselect 1")
+	samples := synthesizeDistribution(q, q.prefix(), "db", []distRow{
+		{vals: map[string]any{"le": 1.0, "n": 2.0, "total": 1.0}},
+		{vals: map[string]any{"le": 5.0, "n": 1.0, "total": 4.0}},
+	})
+
+	var buf bytes.Buffer
+	om := &omSink{w: &buf}
+	if err := om.write(samples); err != nil {
+		t.Fatal(err)
+	}
+	if err := om.close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"# TYPE pgwatch_wait_seconds histogram\n# UNIT pgwatch_wait_seconds seconds\n",
+		`pgwatch_wait_seconds_bucket{le="+Inf",db="db"} 3`,
+		`pgwatch_wait_seconds_sum{db="db"} 5`,
+	} {
+		if !strings.Contains(buf.String(), line) {
+			t.Errorf("openmetrics output misses %q:\n%s", line, buf.String())
+		}
+	}
+
+	req := buildOTLPRequest(samples, "host:5432")
+	metrics := req.ResourceMetrics[0].ScopeMetrics[0].Metrics
+	if len(metrics) != 1 {
+		t.Fatalf("otlp metrics = %v", metrics)
+	}
+	h, ok := metrics[0].Data.(*metricspb.Metric_Histogram)
+	if !ok || len(h.Histogram.DataPoints) != 1 {
+		t.Fatalf("otlp data = %v", metrics[0].Data)
+	}
+	dp := h.Histogram.DataPoints[0]
+	if dp.Count != 3 || dp.GetSum() != 5 || len(dp.ExplicitBounds) != 2 || len(dp.BucketCounts) != 3 || dp.BucketCounts[1] != 1 || dp.BucketCounts[2] != 0 {
+		t.Errorf("otlp histogram point = %v", dp)
+	}
+}
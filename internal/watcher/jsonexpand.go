@@ -0,0 +1,190 @@
+package watcher
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// jsonSpec flattens json/jsonb columns. Paths are dotted, starting with the column
+// name ("stats" or "stats.io.reads"); array elements are addressed by index.
+type jsonSpec struct {
+	paths  []string // subtrees whose numeric leaves become metrics
+	labels []string // string leaves that become labels
+}
+
+// jsonOf returns the json expansion of the query; annotations replace -json / -json-labels
+func (q queryDef) jsonOf() *jsonSpec {
+	if q.json != nil {
+		return q.json
+	}
+	return flagParam.json
+}
+
+// parseJSONSpec builds a spec from the json and json_labels lists; nil if both are empty
+func parseJSONSpec(paths, labels string) *jsonSpec {
+	spec := &jsonSpec{paths: splitList(paths), labels: splitList(labels)}
+	if len(spec.paths) == 0 && len(spec.labels) == 0 {
+		return nil
+	}
+	return spec
+}
+
+// annotateJSON handles the json and json_labels annotations
+func annotateJSON(q *queryDef, key, value string) error {
+	if q.json == nil {
+		q.json = &jsonSpec{}
+	}
+	if key == "json" {
+		q.json.paths = splitList(value)
+	} else {
+		q.json.labels = splitList(value)
+	}
+	return nil
+}
+
+// hasColumn tells whether the column is expanded as JSON
+func (j *jsonSpec) hasColumn(column string) bool {
+	if j == nil {
+		return false
+	}
+	for _, list := range [][]string{j.paths, j.labels} {
+		for _, p := range list {
+			if c, _, _ := strings.Cut(p, "."); c == column {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// jsonLeaf is one numeric leaf of a JSON document
+type jsonLeaf struct {
+	path  string // column.a.b
+	value float64
+}
+
+// expandJSON returns the numeric leaves under the configured paths of the column and
+// the configured string leaves as labels. Strings that are not selected as labels are
+// skipped; booleans count as 0/1.
+func (j *jsonSpec) expandJSON(column string, v any) ([]jsonLeaf, []label, error) {
+	doc, err := decodeJSON(v)
+	if err != nil {
+		return nil, nil, fmt.Errorf("column %s: %w", column, err)
+	}
+	var labels []label
+	for _, p := range j.labels {
+		rest, ok := jsonSubPath(p, column)
+		if !ok {
+			continue
+		}
+		if node, found := jsonLookup(doc, rest); found && node != nil {
+			labels = append(labels, label{name: normalizeName(strings.ReplaceAll(p, ".", "_")), value: jsonScalar(node)})
+		}
+	}
+	var leaves []jsonLeaf
+	for _, p := range j.paths {
+		rest, ok := jsonSubPath(p, column)
+		if !ok {
+			continue
+		}
+		if node, found := jsonLookup(doc, rest); found {
+			leaves = jsonWalk(leaves, p, node)
+		}
+	}
+	return leaves, labels, nil
+}
+
+// decodeJSON accepts the decoded value pgx returns for json/jsonb as well as JSON text
+func decodeJSON(v any) (any, error) {
+	var text []byte
+	switch x := v.(type) {
+	case string:
+		text = []byte(x)
+	case []byte:
+		text = x
+	default:
+		return v, nil
+	}
+	var doc any
+	if err := json.Unmarshal(text, &doc); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+	return doc, nil
+}
+
+// jsonSubPath returns the path below the column, if the path belongs to it
+func jsonSubPath(path, column string) ([]string, bool) {
+	parts := strings.Split(path, ".")
+	if parts[0] != column {
+		return nil, false
+	}
+	return parts[1:], true
+}
+
+func jsonLookup(node any, path []string) (any, bool) {
+	for _, key := range path {
+		switch x := node.(type) {
+		case map[string]any:
+			next, ok := x[key]
+			if !ok {
+				return nil, false
+			}
+			node = next
+		case []any:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(x) {
+				return nil, false
+			}
+			node = x[i]
+		default:
+			return nil, false
+		}
+	}
+	return node, true
+}
+
+// jsonWalk appends the numeric leaves of node in key order
+func jsonWalk(leaves []jsonLeaf, path string, node any) []jsonLeaf {
+	switch x := node.(type) {
+	case map[string]any:
+		keys := make([]string, 0, len(x))
+		for k := range x {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			leaves = jsonWalk(leaves, path+"."+k, x[k])
+		}
+	case []any:
+		for i, el := range x {
+			leaves = jsonWalk(leaves, path+"."+strconv.Itoa(i), el)
+		}
+	case bool:
+		f := 0.0
+		if x {
+			f = 1
+		}
+		leaves = append(leaves, jsonLeaf{path: path, value: f})
+	case string:
+		// text leaves are only used as labels
+	default:
+		if f, ok := toFloat64(x); ok && !math.IsNaN(f) && !math.IsInf(f, 0) {
+			leaves = append(leaves, jsonLeaf{path: path, value: f})
+		}
+	}
+	return leaves
+}
+
+func jsonScalar(node any) string {
+	switch x := node.(type) {
+	case string:
+		return x
+	case float64:
+		return formatFloat(x)
+	}
+	return labelVal(node)
+}
@@ -0,0 +1,59 @@
+package watcher
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Test flattening a jsonb document into numeric leaves and labels
+func TestExpandJSON(t *testing.T) {
+	q, err := parseQueryDef("-- json: stats.io, stats.replicas\n-- json_labels: stats.server.name, stats.server.port\nselect stats from f()")
+	if err != nil {
+		t.Fatalf("parseQueryDef() error = %v", err)
+	}
+	spec := q.jsonOf()
+	if !spec.hasColumn("stats") || spec.hasColumn("other") {
+		t.Fatalf("hasColumn() wrong for %+v", spec)
+	}
+
+	doc := map[string]any{
+		"server":   map[string]any{"name": "pg1", "port": 5432.0},
+		"io":       map[string]any{"reads": 10.0, "writes": 2.0, "mode": "direct", "sync": true},
+		"replicas": []any{map[string]any{"lag": 1.5}, map[string]any{"lag": 0.0}},
+		"ignored":  3.0,
+	}
+	leaves, labels, err := spec.expandJSON("stats", doc)
+	if err != nil {
+		t.Fatalf("expandJSON() error = %v", err)
+	}
+	wantLeaves := []jsonLeaf{
+		{"stats.io.reads", 10}, {"stats.io.sync", 1}, {"stats.io.writes", 2},
+		{"stats.replicas.0.lag", 1.5}, {"stats.replicas.1.lag", 0},
+	}
+	if !reflect.DeepEqual(leaves, wantLeaves) {
+		t.Errorf("leaves = %v, want %v", leaves, wantLeaves)
+	}
+	wantLabels := []label{{"stats_server_name", "pg1"}, {"stats_server_port", "5432"}}
+	if !reflect.DeepEqual(labels, wantLabels) {
+		t.Errorf("labels = %v, want %v", labels, wantLabels)
+	}
+
+	// JSON text is decoded as well
+	leaves, _, err = spec.expandJSON("stats", `{"io": {"reads": 7}}`)
+	if err != nil || len(leaves) != 1 || leaves[0].value != 7 {
+		t.Errorf("expandJSON(text) = %v, %v", leaves, err)
+	}
+	if _, _, err := spec.expandJSON("stats", "{broken"); err == nil {
+		t.Error("expandJSON(invalid) expected error")
+	}
+}
+
+func TestJSONDefaults(t *testing.T) {
+	flagParam = FlagParam{json: parseJSONSpec("doc", "")}
+	if !(queryDef{}).jsonOf().hasColumn("doc") {
+		t.Error("plain query did not inherit -json")
+	}
+	if parseJSONSpec(" ", "") != nil {
+		t.Error("parseJSONSpec() of empty lists should be nil")
+	}
+}
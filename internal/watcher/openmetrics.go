@@ -0,0 +1,148 @@
+package watcher
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// knownUnits are metric name suffixes recognized as OpenMetrics units
+var knownUnits = []string{"bytes", "seconds", "milliseconds", "microseconds", "ratio", "percent", "celsius"}
+
+// unitFor returns the unit of a column: -units wins, otherwise it is taken from a known name suffix
+func unitFor(column string) string {
+	if u, ok := flagParam.columnUnits[column]; ok {
+		return normalizeName(u)
+	}
+	name := normalizeName(column)
+	for _, u := range knownUnits {
+		if strings.HasSuffix(name, "_"+u) {
+			return u
+		}
+	}
+	return ""
+}
+
+// omSink buffers all samples and prints them grouped by metric family on close,
+// because OpenMetrics requires a family's samples to be contiguous
+type omSink struct {
+	mu       sync.Mutex
+	w        io.Writer
+	order    []string
+	families map[string]*omFamily
+}
+
+type omFamily struct {
+	name    string
+	kind    metricKind
+	unit    string
+	help    string
+	samples []sample
+}
+
+func (o *omSink) write(samples []sample) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.families == nil {
+		o.families = make(map[string]*omFamily)
+	}
+	for _, s := range samples {
+		name := omFamilyName(&s)
+		f, ok := o.families[name]
+		if !ok {
+			f = &omFamily{name: name, kind: s.kind, unit: s.unit, help: s.help}
+			o.families[name] = f
+			o.order = append(o.order, name)
+		}
+		f.samples = append(f.samples, s)
+	}
+	return nil
+}
+
+func (o *omSink) close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var b strings.Builder
+	for _, name := range o.order {
+		formatOMFamily(&b, o.families[name])
+	}
+	b.WriteString("# EOF\n")
+	o.families, o.order = nil, nil
+	_, err := io.WriteString(o.w, b.String())
+	return err
+}
+
+// omFamilyName returns the family name: the unit is appended as a suffix when missing
+// and a counter's _total suffix is stripped (it is added back on the sample lines)
+func omFamilyName(s *sample) string {
+	name := s.name
+	if s.family != "" {
+		name = s.family
+	}
+	if s.kind == kindCounter {
+		name = strings.TrimSuffix(name, "_total")
+	}
+	if s.unit != "" && !strings.HasSuffix(name, "_"+s.unit) {
+		name += "_" + s.unit
+	}
+	return name
+}
+
+func formatOMFamily(b *strings.Builder, f *omFamily) {
+	typ, sampleName := "gauge", f.name
+	switch f.kind {
+	case kindCounter:
+		typ, sampleName = "counter", f.name+"_total"
+	case kindHistogram:
+		typ = "histogram"
+	case kindSummary:
+		typ = "summary"
+	}
+	fmt.Fprintf(b, "# TYPE %s %s\n", f.name, typ)
+	if f.unit != "" {
+		fmt.Fprintf(b, "# UNIT %s %s\n", f.name, f.unit)
+	}
+	if f.help != "" {
+		fmt.Fprintf(b, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+	}
+	for i := range f.samples {
+		s := &f.samples[i]
+		b.WriteString(sampleName)
+		if s.family != "" {
+			// _bucket, _sum or _count of a histogram or summary
+			b.WriteString(strings.TrimPrefix(s.name, s.family))
+		}
+		sep := byte('{')
+		for _, l := range s.labels {
+			b.WriteByte(sep)
+			fmt.Fprintf(b, `%s="%s"`, l.name, escapeLabelValue(l.value))
+			sep = ','
+		}
+		if s.db != "" {
+			b.WriteByte(sep)
+			fmt.Fprintf(b, `db="%s"`, escapeLabelValue(s.db))
+			sep = ','
+		}
+		if sep == ',' {
+			b.WriteByte('}')
+		}
+		fmt.Fprintf(b, ` %s`, formatFloat(s.value))
+		if !s.ts.IsZero() {
+			b.WriteByte(' ')
+			b.WriteString(strconv.FormatFloat(float64(s.ts.UnixMilli())/1000, 'f', -1, 64))
+		}
+		b.WriteByte('\n')
+	}
+}
+
+// escapeHelp escapes backslash and newline in HELP text
+func escapeHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
+
+// escapeLabelValue escapes backslash, double quote and newline as required by the text formats
+func escapeLabelValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
@@ -0,0 +1,56 @@
+package watcher
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// Test OpenMetrics exposition: grouping, _total suffix, units, timestamps and EOF
+func TestOMSink(t *testing.T) {
+	var buf bytes.Buffer
+	o := &omSink{w: &buf}
+	ts := time.UnixMilli(1700000000500)
+	_ = o.write([]sample{
+		{name: "pgwatch_xact_commit", db: "db1", kind: kindCounter, value: 10},
+		{name: "pgwatch_size", db: "db1", unit: "bytes", value: 1024, labels: []label{{"relname", `a"b`}}},
+	})
+	_ = o.write([]sample{
+		{name: "pgwatch_xact_commit", db: "db2", kind: kindCounter, value: 20, ts: ts},
+		{name: "pgwatch_patroni_paused", value: 0},
+	})
+	if err := o.close(); err != nil {
+		t.Fatalf("close() error = %v", err)
+	}
+	want := "# TYPE pgwatch_xact_commit counter\n" +
+		"pgwatch_xact_commit_total{db=\"db1\"} 10\n" +
+		"pgwatch_xact_commit_total{db=\"db2\"} 20 1700000000.5\n" +
+		"# TYPE pgwatch_size_bytes gauge\n" +
+		"# UNIT pgwatch_size_bytes bytes\n" +
+		"pgwatch_size_bytes{relname=\"a\\\"b\",db=\"db1\"} 1024\n" +
+		"# TYPE pgwatch_patroni_paused gauge\n" +
+		"pgwatch_patroni_paused 0\n" +
+		"# EOF\n"
+	if buf.String() != want {
+		t.Errorf("output =\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+// Test unit detection from -units and name suffixes
+func TestUnitFor(t *testing.T) {
+	flagParam = FlagParam{columnUnits: map[string]string{"lag": "bytes"}}
+	tests := []struct {
+		column   string
+		expected string
+	}{
+		{"lag", "bytes"},
+		{"total_exec_seconds", "seconds"},
+		{"table_size_bytes", "bytes"},
+		{"calls", ""},
+	}
+	for _, tt := range tests {
+		if got := unitFor(tt.column); got != tt.expected {
+			t.Errorf("unitFor(%q) = %q, want %q", tt.column, got, tt.expected)
+		}
+	}
+}
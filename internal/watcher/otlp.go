@@ -0,0 +1,377 @@
+package watcher
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	otlpProtocolHTTP = "http/protobuf"
+	otlpProtocolGRPC = "grpc"
+
+	defaultOTLPHTTPEndpoint = "http://127.0.0.1:4318/v1/metrics"
+	defaultOTLPGRPCEndpoint = "127.0.0.1:4317"
+)
+
+// otlpSink buffers all samples of a run and exports them in a single OTLP request on close
+type otlpSink struct {
+	mu      sync.Mutex
+	samples []sample
+	target  string
+}
+
+func newOTLPSink() (*otlpSink, error) {
+	switch flagParam.otlpProtocol {
+	case otlpProtocolHTTP, otlpProtocolGRPC:
+	default:
+		return nil, fmt.Errorf("unknown OTLP protocol %q (use %s or %s)",
+			flagParam.otlpProtocol, otlpProtocolHTTP, otlpProtocolGRPC)
+	}
+	return &otlpSink{target: targetName(connParam.connstr)}, nil
+}
+
+func (o *otlpSink) write(samples []sample) error {
+	now := time.Now()
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, s := range samples {
+		if s.ts.IsZero() {
+			s.ts = now
+		}
+		o.samples = append(o.samples, s)
+	}
+	return nil
+}
+
+func (o *otlpSink) close() error {
+	o.mu.Lock()
+	req := buildOTLPRequest(o.samples, o.target)
+	o.samples = nil
+	o.mu.Unlock()
+	if len(req.ResourceMetrics) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), flagParam.otlpTimeout)
+	defer cancel()
+	if flagParam.otlpProtocol == otlpProtocolGRPC {
+		return exportOTLPGRPC(ctx, req)
+	}
+	return exportOTLPHTTP(ctx, req)
+}
+
+// buildOTLPRequest groups samples into one resource per target and database and one
+// metric per name. Labels become data point attributes, db and target (the
+// -targets-file instance if any) become resource attributes,
+// counters become cumulative monotonic sums and everything else a gauge.
+func buildOTLPRequest(samples []sample, target string) *colmetricspb.ExportMetricsServiceRequest {
+	req := &colmetricspb.ExportMetricsServiceRequest{}
+	scopes := make(map[string]*metricspb.ScopeMetrics)
+	metrics := make(map[string]*metricspb.Metric)
+	dists := make(map[string]*otlpDistPoint)
+
+	for i := range samples {
+		s := &samples[i]
+		resource := s.target + "\x00" + s.db
+		sm, ok := scopes[resource]
+		if !ok {
+			instance := target
+			if s.target != "" {
+				instance = s.target
+			}
+			sm = &metricspb.ScopeMetrics{
+				Scope: &commonpb.InstrumentationScope{Name: "pg_watcher", Version: flagParam.build},
+			}
+			attrs := []*commonpb.KeyValue{otlpString("service.name", "pg_watcher")}
+			if s.db != "" { // node-wide samples (Patroni) have no database
+				attrs = append(attrs, otlpString("db", s.db))
+			}
+			req.ResourceMetrics = append(req.ResourceMetrics, &metricspb.ResourceMetrics{
+				Resource:     &resourcepb.Resource{Attributes: append(attrs, otlpString("target", instance))},
+				ScopeMetrics: []*metricspb.ScopeMetrics{sm},
+			})
+			scopes[resource] = sm
+		}
+
+		name := s.name
+		if s.family != "" {
+			name = s.family
+		}
+		key := resource + "\x00" + name
+		m, ok := metrics[key]
+		if !ok {
+			m = &metricspb.Metric{Name: name, Description: s.help, Unit: otlpUnit(s.unit)}
+			switch s.kind {
+			case kindCounter:
+				m.Data = &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+					AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+					IsMonotonic:            true,
+				}}
+			case kindHistogram:
+				m.Data = &metricspb.Metric_Histogram{Histogram: &metricspb.Histogram{
+					AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+				}}
+			case kindSummary:
+				m.Data = &metricspb.Metric_Summary{Summary: &metricspb.Summary{}}
+			default:
+				m.Data = &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{}}
+			}
+			sm.Metrics = append(sm.Metrics, m)
+			metrics[key] = m
+		}
+
+		switch d := m.Data.(type) {
+		case *metricspb.Metric_Histogram, *metricspb.Metric_Summary:
+			addOTLPDistSample(m, s, dists)
+			continue
+		case *metricspb.Metric_Sum:
+			d.Sum.DataPoints = append(d.Sum.DataPoints, otlpNumberPoint(s))
+		case *metricspb.Metric_Gauge:
+			d.Gauge.DataPoints = append(d.Gauge.DataPoints, otlpNumberPoint(s))
+		}
+	}
+	for _, p := range dists {
+		p.finish()
+	}
+	return req
+}
+
+func otlpNumberPoint(s *sample) *metricspb.NumberDataPoint {
+	dp := &metricspb.NumberDataPoint{
+		TimeUnixNano: uint64(s.ts.UnixNano()),
+		Value:        &metricspb.NumberDataPoint_AsDouble{AsDouble: s.value},
+	}
+	for _, l := range s.labels {
+		dp.Attributes = append(dp.Attributes, otlpString(l.name, l.value))
+	}
+	return dp
+}
+
+// otlpDistPoint collects the _bucket/_sum/_count or quantile samples of one
+// histogram or summary series into a single data point
+type otlpDistPoint struct {
+	hist *metricspb.HistogramDataPoint
+	summ *metricspb.SummaryDataPoint
+	cum  []float64 // cumulative bucket counts in bound order, +Inf last
+}
+
+func addOTLPDistSample(m *metricspb.Metric, s *sample, dists map[string]*otlpDistPoint) {
+	// the le and quantile labels identify the part, not the series
+	var attrs []*commonpb.KeyValue
+	var le, quantile string
+	for _, l := range s.labels {
+		switch {
+		case s.kind == kindHistogram && l.name == "le":
+			le = l.value
+		case s.kind == kindSummary && l.name == "quantile":
+			quantile = l.value
+		default:
+			attrs = append(attrs, otlpString(l.name, l.value))
+		}
+	}
+	key := s.target + "\x00" + s.db + "\x00" + s.family + "\x00" + labelsString(withoutLabel(s.labels, "le", "quantile"))
+	p, ok := dists[key]
+	if !ok {
+		p = &otlpDistPoint{}
+		ts := uint64(s.ts.UnixNano())
+		switch d := m.Data.(type) {
+		case *metricspb.Metric_Histogram:
+			p.hist = &metricspb.HistogramDataPoint{TimeUnixNano: ts, Attributes: attrs}
+			d.Histogram.DataPoints = append(d.Histogram.DataPoints, p.hist)
+		case *metricspb.Metric_Summary:
+			p.summ = &metricspb.SummaryDataPoint{TimeUnixNano: ts, Attributes: attrs}
+			d.Summary.DataPoints = append(d.Summary.DataPoints, p.summ)
+		}
+		dists[key] = p
+	}
+
+	suffix := strings.TrimPrefix(s.name, s.family)
+	switch {
+	case p.hist != nil && suffix == "_bucket":
+		if le != "+Inf" {
+			if bound, err := strconv.ParseFloat(le, 64); err == nil {
+				p.hist.ExplicitBounds = append(p.hist.ExplicitBounds, bound)
+			}
+		}
+		p.cum = append(p.cum, s.value)
+	case p.hist != nil && suffix == "_count":
+		p.hist.Count = uint64(s.value)
+	case p.hist != nil && suffix == "_sum":
+		p.hist.Sum = &s.value
+	case p.summ != nil && suffix == "_count":
+		p.summ.Count = uint64(s.value)
+	case p.summ != nil && suffix == "_sum":
+		p.summ.Sum = s.value
+	case p.summ != nil:
+		if q, err := strconv.ParseFloat(quantile, 64); err == nil {
+			p.summ.QuantileValues = append(p.summ.QuantileValues,
+				&metricspb.SummaryDataPoint_ValueAtQuantile{Quantile: q, Value: s.value})
+		}
+	}
+}
+
+// finish turns cumulative Prometheus buckets into OTLP per-bucket counts
+func (p *otlpDistPoint) finish() {
+	if p.hist == nil {
+		return
+	}
+	prev := 0.0
+	for _, c := range p.cum {
+		p.hist.BucketCounts = append(p.hist.BucketCounts, uint64(c-prev))
+		prev = c
+	}
+}
+
+func withoutLabel(labels []label, names ...string) []label {
+	var res []label
+	for _, l := range labels {
+		if !slices.Contains(names, l.name) {
+			res = append(res, l)
+		}
+	}
+	return res
+}
+
+// otlpUnit maps OpenMetrics unit names to the UCUM codes used by OTLP
+func otlpUnit(unit string) string {
+	switch unit {
+	case "bytes":
+		return "By"
+	case "seconds":
+		return "s"
+	case "milliseconds":
+		return "ms"
+	case "microseconds":
+		return "us"
+	case "ratio":
+		return "1"
+	case "percent":
+		return "%"
+	case "celsius":
+		return "Cel"
+	}
+	return unit
+}
+
+func otlpString(k, v string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: k, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: v}}}
+}
+
+// exportOTLPHTTP posts the request as binary protobuf
+func exportOTLPHTTP(ctx context.Context, req *colmetricspb.ExportMetricsServiceRequest) error {
+	body, err := proto.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("otlp marshal: %w", err)
+	}
+	endpoint := flagParam.otlpEndpoint
+	if endpoint == "" {
+		endpoint = defaultOTLPHTTPEndpoint
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("otlp request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/x-protobuf")
+	for k, v := range flagParam.otlpHeaders {
+		httpReq.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("otlp export: %w", err)
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("otlp export: %s: %s", resp.Status, strings.TrimSpace(string(respBody)))
+	}
+	var exportResp colmetricspb.ExportMetricsServiceResponse
+	if err := proto.Unmarshal(respBody, &exportResp); err == nil {
+		logPartialSuccess(&exportResp)
+	}
+	return nil
+}
+
+// exportOTLPGRPC sends the request to the collector MetricsService
+func exportOTLPGRPC(ctx context.Context, req *colmetricspb.ExportMetricsServiceRequest) error {
+	endpoint := flagParam.otlpEndpoint
+	if endpoint == "" {
+		endpoint = defaultOTLPGRPCEndpoint
+	}
+	creds := insecure.NewCredentials()
+	if rest, ok := strings.CutPrefix(endpoint, "https://"); ok {
+		endpoint = rest
+		creds = credentials.NewTLS(&tls.Config{MinVersion: tls.VersionTLS12})
+	} else {
+		endpoint = strings.TrimPrefix(endpoint, "http://")
+	}
+	cc, err := grpc.NewClient(endpoint, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return fmt.Errorf("otlp grpc dial: %w", err)
+	}
+	defer cc.Close()
+
+	if len(flagParam.otlpHeaders) > 0 {
+		ctx = metadata.NewOutgoingContext(ctx, metadata.New(flagParam.otlpHeaders))
+	}
+	resp, err := colmetricspb.NewMetricsServiceClient(cc).Export(ctx, req)
+	if err != nil {
+		return fmt.Errorf("otlp export: %w", err)
+	}
+	logPartialSuccess(resp)
+	return nil
+}
+
+func logPartialSuccess(resp *colmetricspb.ExportMetricsServiceResponse) {
+	ps := resp.GetPartialSuccess()
+	if ps.GetRejectedDataPoints() > 0 || ps.GetErrorMessage() != "" {
+		log.Printf("otlp: collector rejected %d data points: %s", ps.GetRejectedDataPoints(), ps.GetErrorMessage())
+	}
+}
+
+// targetName returns host:port of the connection string, used to identify the scraped server
+func targetName(connstr string) string {
+	cfg, err := pgx.ParseConfig(connstr)
+	if err != nil {
+		return ""
+	}
+	return net.JoinHostPort(cfg.Host, strconv.Itoa(int(cfg.Port)))
+}
+
+// parseKeyValueList parses "k1=v1,k2=v2" as used by -otlp-headers
+func parseKeyValueList(s string) (map[string]string, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	m := make(map[string]string)
+	for _, it := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(it, "=")
+		k = strings.TrimSpace(k)
+		if !ok || k == "" {
+			return nil, fmt.Errorf("invalid key=value pair %q", it)
+		}
+		m[k] = strings.TrimSpace(v)
+	}
+	return m, nil
+}
@@ -0,0 +1,89 @@
+package watcher
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// Test grouping of samples into resources, metrics and data points
+func TestBuildOTLPRequest(t *testing.T) {
+	ts := time.Unix(1700000000, 0)
+	samples := []sample{
+		{name: "pgwatch_xact_commit", db: "db1", kind: kindCounter, value: 10, labels: []label{{"datname", "db1"}}, ts: ts},
+		{name: "pgwatch_numbackends", db: "db1", value: 3, labels: []label{{"datname", "db1"}}, ts: ts},
+		{name: "pgwatch_xact_commit", db: "db1", kind: kindCounter, value: 20, labels: []label{{"datname", "db2"}}, ts: ts},
+		{name: "pgwatch_numbackends", db: "db2", value: 1, ts: ts},
+	}
+	req := buildOTLPRequest(samples, "127.0.0.1:5432")
+
+	if len(req.ResourceMetrics) != 2 {
+		t.Fatalf("resources = %d, want 2", len(req.ResourceMetrics))
+	}
+	attrs := map[string]string{}
+	for _, kv := range req.ResourceMetrics[0].Resource.Attributes {
+		attrs[kv.Key] = kv.Value.GetStringValue()
+	}
+	if attrs["db"] != "db1" || attrs["target"] != "127.0.0.1:5432" {
+		t.Errorf("resource attributes = %v", attrs)
+	}
+
+	metrics := req.ResourceMetrics[0].ScopeMetrics[0].Metrics
+	if len(metrics) != 2 {
+		t.Fatalf("metrics = %d, want 2", len(metrics))
+	}
+	sum := metrics[0].GetSum()
+	if sum == nil || !sum.IsMonotonic || len(sum.DataPoints) != 2 {
+		t.Fatalf("counter not mapped to monotonic sum with 2 points: %v", metrics[0])
+	}
+	if got := sum.DataPoints[1].Attributes[0].Value.GetStringValue(); got != "db2" {
+		t.Errorf("data point attribute = %q, want db2", got)
+	}
+	if metrics[1].GetGauge() == nil {
+		t.Errorf("gauge not mapped to Gauge: %v", metrics[1])
+	}
+	if got := sum.DataPoints[0].TimeUnixNano; got != uint64(ts.UnixNano()) {
+		t.Errorf("TimeUnixNano = %d, want %d", got, ts.UnixNano())
+	}
+}
+
+// Test HTTP/protobuf export against a local collector stand-in
+func TestExportOTLPHTTP(t *testing.T) {
+	var got colmetricspb.ExportMetricsServiceRequest
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if err := proto.Unmarshal(body, &got); err != nil {
+			t.Errorf("unmarshal: %v", err)
+		}
+		auth = r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	flagParam = FlagParam{otlpEndpoint: srv.URL + "/v1/metrics", otlpHeaders: map[string]string{"Authorization": "Bearer x"}}
+	req := buildOTLPRequest([]sample{{name: "m", db: "d", value: 1}}, "")
+	if err := exportOTLPHTTP(context.Background(), req); err != nil {
+		t.Fatalf("exportOTLPHTTP() error = %v", err)
+	}
+	if len(got.ResourceMetrics) != 1 || auth != "Bearer x" {
+		t.Errorf("collector got %d resources, auth %q", len(got.ResourceMetrics), auth)
+	}
+}
+
+// Test -otlp-headers parsing
+func TestParseKeyValueList(t *testing.T) {
+	m, err := parseKeyValueList("a=1, b = 2")
+	if err != nil || m["a"] != "1" || m["b"] != "2" {
+		t.Errorf("parseKeyValueList() = %v, %v", m, err)
+	}
+	if _, err := parseKeyValueList("novalue"); err == nil {
+		t.Error("expected error for pair without '='")
+	}
+}
@@ -0,0 +1,125 @@
+package watcher
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metricKind tells output formats how a metric behaves over time
+type metricKind int
+
+const (
+	kindGauge metricKind = iota
+	kindCounter
+	// kindHistogram and kindSummary samples are parts (_bucket, _sum, _count,
+	// quantiles) of the distribution named by sample.family
+	kindHistogram
+	kindSummary
+)
+
+// label is one name/value pair; order follows the SELECT column order
+type label struct {
+	name  string
+	value string
+}
+
+// sample is a single collected value together with everything needed to render it
+type sample struct {
+	name   string  // normalized metric name: <prefix>_<column>
+	family string  // histogram/summary name without the _bucket/_sum/_count suffix
+	prefix string  // metric prefix the name was built from
+	column string  // source column name
+	db     string  // database the value was collected from
+	target string  // -targets-file instance, empty for the single -conn server
+	labels []label // column labels in SELECT order (db is not included)
+	value  float64
+	kind   metricKind
+	unit   string    // OpenMetrics unit (bytes, seconds, ...), empty if unknown
+	help   string    // metric description, empty if unknown
+	ts     time.Time // sample timestamp; zero means "no timestamp"
+	// resetMark changes when the source counters were reset (not printed)
+	resetMark string
+}
+
+// sink receives samples from all databases; implementations must be safe for concurrent use
+type sink interface {
+	write(samples []sample) error
+	// close flushes buffered samples; it is called once after all databases are processed
+	close() error
+}
+
+const (
+	formatPrometheus  = "prometheus"
+	formatOpenMetrics = "openmetrics"
+	formatOTLP        = "otlp"
+)
+
+// stdout is where text formats are written; tests may replace it
+var stdout io.Writer = os.Stdout
+
+// out is the sink used by processDB, configured by Run
+var out sink = &promSink{w: stdout}
+
+// newSink builds the sink selected by -output-format
+func newSink(format string) (sink, error) {
+	switch format {
+	case "", formatPrometheus:
+		return &promSink{w: stdout}, nil
+	case formatOpenMetrics:
+		return &omSink{w: stdout}, nil
+	case formatOTLP:
+		return newOTLPSink()
+	case formatGraphite, formatStatsD:
+		return newLineSink(format)
+	default:
+		return nil, fmt.Errorf("unknown output format %q", format)
+	}
+}
+
+// promSink prints samples in the Prometheus text format understood by Telegraf
+type promSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (p *promSink) write(samples []sample) error {
+	var b strings.Builder
+	for i := range samples {
+		formatPromLine(&b, &samples[i])
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, err := io.WriteString(p.w, b.String())
+	return err
+}
+
+func (p *promSink) close() error { return nil }
+
+// formatPromLine renders one sample as name{labels,db="..."} value; node-wide
+// samples without a database (Patroni) have no db label
+func formatPromLine(b *strings.Builder, s *sample) {
+	b.WriteString(s.name)
+	sep := byte('{')
+	for _, l := range s.labels {
+		b.WriteByte(sep)
+		fmt.Fprintf(b, `%s="%s"`, l.name, l.value)
+		sep = ','
+	}
+	if s.db != "" {
+		b.WriteByte(sep)
+		fmt.Fprintf(b, "db=%q", s.db)
+		sep = ','
+	}
+	if sep == ',' {
+		b.WriteByte('}')
+	}
+	fmt.Fprintf(b, " %g", s.value)
+	if !s.ts.IsZero() {
+		fmt.Fprintf(b, " %d", s.ts.UnixMilli())
+	}
+	b.WriteByte('\n')
+}
@@ -0,0 +1,46 @@
+package watcher
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Test Prometheus line rendering matches the historical output
+func TestPromSinkWrite(t *testing.T) {
+	var buf bytes.Buffer
+	p := &promSink{w: &buf}
+	err := p.write([]sample{
+		{name: "pgwatch_calls", db: "postgres", labels: []label{{"user", "app"}, {"state", "idle"}}, value: 5},
+		{name: "pgwatch_size", db: "testdb", value: 2.409e+08},
+	})
+	if err != nil {
+		t.Fatalf("write() error = %v", err)
+	}
+	want := "pgwatch_calls{user=\"app\",state=\"idle\",db=\"postgres\"} 5\n" +
+		"pgwatch_size{db=\"testdb\"} 2.409e+08\n"
+	if buf.String() != want {
+		t.Errorf("write() output = %q, want %q", buf.String(), want)
+	}
+}
+
+// Test sink selection by -output-format
+func TestNewSink(t *testing.T) {
+	flagParam = FlagParam{otlpProtocol: otlpProtocolHTTP}
+	tests := []struct {
+		format  string
+		wantErr bool
+	}{
+		{"", false},
+		{formatPrometheus, false},
+		{formatOTLP, false},
+		{"xml", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			_, err := newSink(tt.format)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("newSink(%q) error = %v, wantErr %v", tt.format, err, tt.wantErr)
+			}
+		})
+	}
+}
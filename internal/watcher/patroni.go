@@ -0,0 +1,191 @@
+package watcher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// patroniStatus is the part of Patroni's GET /patroni response pg_watcher uses
+type patroniStatus struct {
+	State            string `json:"state"`
+	Role             string `json:"role"`
+	Timeline         int64  `json:"timeline"`
+	Pause            bool   `json:"pause"`
+	PendingRestart   bool   `json:"pending_restart"`
+	ReplicationState string `json:"replication_state"`
+	Patroni          struct {
+		Version string `json:"version"`
+		Scope   string `json:"scope"`
+		Name    string `json:"name"`
+	} `json:"patroni"`
+}
+
+// patroniMember is one member of Patroni's GET /cluster response
+type patroniMember struct {
+	Name  string          `json:"name"`
+	Role  string          `json:"role"`
+	State string          `json:"state"`
+	Lag   json.RawMessage `json:"lag"` // bytes, or "unknown"
+}
+
+// patroniNode is what the local Patroni reports about this node
+type patroniNode struct {
+	status patroniStatus
+	role   string // rolePrimary, roleStandbyLeader, roleSyncReplica, roleAsyncReplica or roleReplica
+	lag    float64
+	hasLag bool
+}
+
+// nodeLabels are added to every series with -patroni-labels; set once per run
+var nodeLabels []label
+
+// fetchPatroni reads /patroni and, for the sync state and lag of a replica, /cluster
+func fetchPatroni(ctxParent context.Context, baseURL string) (*patroniNode, error) {
+	ctx, cancel := context.WithTimeout(ctxParent, flagParam.pgTimeout)
+	defer cancel()
+	base := strings.TrimRight(baseURL, "/")
+
+	node := &patroniNode{}
+	if err := getJSON(ctx, base+"/patroni", &node.status); err != nil {
+		return nil, err
+	}
+	role, err := patroniRole(node.status.Role)
+	if err != nil {
+		return nil, fmt.Errorf("patroni %s/patroni: %w", base, err)
+	}
+	node.role = role
+	if node.role != roleReplica {
+		return node, nil
+	}
+
+	var cluster struct {
+		Members []patroniMember `json:"members"`
+	}
+	if err := getJSON(ctx, base+"/cluster", &cluster); err != nil {
+		return node, nil // role stays a plain replica
+	}
+	for _, m := range cluster.Members {
+		if m.Name != node.status.Patroni.Name {
+			continue
+		}
+		switch m.Role {
+		case "sync_standby", "quorum_standby":
+			node.role = roleSyncReplica
+		case "replica":
+			node.role = roleAsyncReplica
+		}
+		if lag, err := strconv.ParseFloat(string(m.Lag), 64); err == nil {
+			node.lag, node.hasLag = lag, true
+		}
+	}
+	return node, nil
+}
+
+func getJSON(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("patroni: %w", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("patroni: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("patroni %s: %w", url, err)
+	}
+	// /patroni answers 503 on replicas and stopped nodes but still sends the status
+	if (resp.StatusCode < 200 || resp.StatusCode > 299) && resp.StatusCode != http.StatusServiceUnavailable {
+		return fmt.Errorf("patroni %s: %s", url, resp.Status)
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("patroni %s: %s: %w", url, resp.Status, err)
+	}
+	return nil
+}
+
+// patroniRole maps Patroni's role names to role annotations; an empty or
+// unknown role is an error, so the caller falls back to pg_is_in_recovery()
+func patroniRole(role string) (string, error) {
+	switch role {
+	case "master", "primary":
+		return rolePrimary, nil
+	case "standby_leader":
+		return roleStandbyLeader, nil
+	case "replica":
+		return roleReplica, nil
+	case "":
+		return "", fmt.Errorf("no role in the status")
+	default:
+		return "", fmt.Errorf("unknown role %q", role)
+	}
+}
+
+// labels returns the node labels added to series with -patroni-labels
+func (n *patroniNode) labels() []label {
+	return []label{
+		{name: "patroni_scope", value: n.status.Patroni.Scope},
+		{name: "patroni_member", value: n.status.Patroni.Name},
+		{name: "patroni_role", value: n.role},
+	}
+}
+
+// samples returns the <prefix>_patroni_* node metrics
+func (n *patroniNode) samples() []sample {
+	info := []label{
+		{name: "scope", value: n.status.Patroni.Scope},
+		{name: "member", value: n.status.Patroni.Name},
+		{name: "role", value: n.role},
+		{name: "state", value: n.status.State},
+		{name: "replication_state", value: n.status.ReplicationState},
+		{name: "version", value: n.status.Patroni.Version},
+	}
+	node := []label{{name: "scope", value: n.status.Patroni.Scope}, {name: "member", value: n.status.Patroni.Name}}
+	mk := func(column string, labels []label, v float64, help string) sample {
+		return sample{
+			name:   normalizeName(prefixedName("patroni_" + column)),
+			prefix: flagParam.prefixMetric,
+			column: "patroni_" + column,
+			labels: labels,
+			value:  v,
+			unit:   unitFor(column),
+			help:   help,
+		}
+	}
+	samples := []sample{
+		mk("info", info, 1, "Patroni member information"),
+		mk("timeline", node, float64(n.status.Timeline), "PostgreSQL timeline"),
+		mk("paused", node, boolFloat(n.status.Pause), "Whether the cluster is in maintenance mode"),
+		mk("pending_restart", node, boolFloat(n.status.PendingRestart), "Whether a restart is pending to apply settings"),
+	}
+	if n.hasLag {
+		samples = append(samples, mk("lag_bytes", node, n.lag, "Replication lag reported by Patroni"))
+	}
+	return samples
+}
+
+func boolFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// withNodeLabels appends the -patroni-labels node labels to every sample
+func withNodeLabels(samples []sample) []sample {
+	if len(nodeLabels) == 0 {
+		return samples
+	}
+	res := make([]sample, len(samples))
+	for i, s := range samples {
+		s.labels = append(append([]label(nil), s.labels...), nodeLabels...)
+		res[i] = s
+	}
+	return res
+}
@@ -0,0 +1,139 @@
+package watcher
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// patroniStandIn serves canned /patroni and /cluster responses
+func patroniStandIn(t *testing.T, status, cluster string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/patroni":
+			w.WriteHeader(http.StatusServiceUnavailable) // as Patroni does on replicas
+			w.Write([]byte(status))
+		case "/cluster":
+			w.Write([]byte(cluster))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestFetchPatroniSyncReplica(t *testing.T) {
+	flagParam = FlagParam{prefixMetric: "pgwatch", pgTimeout: 5 * time.Second}
+	srv := patroniStandIn(t,
+		`{"state": "running", "role": "replica", "timeline": 7, "pause": true, "replication_state": "streaming",
+		  "patroni": {"version": "4.0.4", "scope": "main", "name": "pg2"}}`,
+		`{"members": [{"name": "pg1", "role": "leader", "lag": 0}, {"name": "pg2", "role": "sync_standby", "lag": 2048},
+		              {"name": "pg3", "role": "replica", "lag": "unknown"}]}`)
+
+	node, err := fetchPatroni(context.Background(), srv.URL+"/")
+	if err != nil {
+		t.Fatalf("fetchPatroni() error = %v", err)
+	}
+	if node.role != roleSyncReplica || !node.hasLag || node.lag != 2048 {
+		t.Errorf("node = %+v", node)
+	}
+
+	samples := node.samples()
+	byName := make(map[string]sample)
+	for _, s := range samples {
+		byName[s.name] = s
+	}
+	if s := byName["pgwatch_patroni_paused"]; s.value != 1 {
+		t.Errorf("paused = %+v", s)
+	}
+	if s := byName["pgwatch_patroni_timeline"]; s.value != 7 {
+		t.Errorf("timeline = %+v", s)
+	}
+	if s := byName["pgwatch_patroni_lag_bytes"]; s.value != 2048 || s.unit != "bytes" {
+		t.Errorf("lag = %+v", s)
+	}
+	if info := byName["pgwatch_patroni_info"]; info.labels[2] != (label{"role", roleSyncReplica}) {
+		t.Errorf("info labels = %v", info.labels)
+	}
+	// node-wide series carry no db label
+	if got, want := promText(samples[1:2]), "pgwatch_patroni_timeline{scope=\"main\",member=\"pg2\"} 7\n"; got != want {
+		t.Errorf("timeline = %q, want %q", got, want)
+	}
+}
+
+func TestFetchPatroniRoles(t *testing.T) {
+	flagParam = FlagParam{pgTimeout: 5 * time.Second}
+	tests := []struct {
+		status, cluster, want string
+	}{
+		{`{"role": "primary", "patroni": {"name": "pg1"}}`, `{}`, rolePrimary},
+		{`{"role": "standby_leader", "patroni": {"name": "pg1"}}`, `{}`, roleStandbyLeader},
+		{`{"role": "replica", "patroni": {"name": "pg3"}}`, `{"members": [{"name": "pg3", "role": "replica"}]}`, roleAsyncReplica},
+		{`{"role": "replica", "patroni": {"name": "pg3"}}`, `not json`, roleReplica},
+	}
+	for _, tt := range tests {
+		node, err := fetchPatroni(context.Background(), patroniStandIn(t, tt.status, tt.cluster).URL)
+		if err != nil || node.role != tt.want {
+			t.Errorf("fetchPatroni(%s) role = %v, %v; want %s", tt.status, node, err, tt.want)
+		}
+	}
+	for _, status := range []string{"oops", `{"patroni": {"name": "pg1"}}`, `{"role": "demoted", "patroni": {"name": "pg1"}}`} {
+		if _, err := fetchPatroni(context.Background(), patroniStandIn(t, status, "").URL); err == nil {
+			t.Errorf("fetchPatroni(%s) expected error", status)
+		}
+	}
+
+	// only 503 of the error statuses still carries a usable status
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"role": "primary", "patroni": {"name": "pg1"}}`))
+	}))
+	defer srv.Close()
+	if _, err := fetchPatroni(context.Background(), srv.URL); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("fetchPatroni() with 401 error = %v", err)
+	}
+}
+
+// Test role gating and -master-only / -replica-only with finer replica roles
+func TestRoleGating(t *testing.T) {
+	flagParam = FlagParam{}
+	for _, tt := range []struct {
+		query, node string
+		want        bool
+	}{
+		{roleReplica, roleSyncReplica, true},
+		{roleReplica, roleStandbyLeader, true},
+		{roleReplica, rolePrimary, false},
+		{roleSyncReplica, roleAsyncReplica, false},
+		{roleSyncReplica, roleReplica, false},
+		{roleStandbyLeader, roleStandbyLeader, true},
+	} {
+		if got := (queryDef{role: tt.query}).runsOn(tt.node); got != tt.want {
+			t.Errorf("role %s runsOn(%s) = %v, want %v", tt.query, tt.node, got, tt.want)
+		}
+	}
+
+	flagParam.masterOnly = true
+	if err := checkNodeRole(roleStandbyLeader); err == nil || nodeRole != roleStandbyLeader {
+		t.Errorf("checkNodeRole(standby_leader) with -master-only = %v", err)
+	}
+	flagParam = FlagParam{replicaOnly: true}
+	if err := checkNodeRole(roleAsyncReplica); err != nil {
+		t.Errorf("checkNodeRole(async_replica) with -replica-only = %v", err)
+	}
+}
+
+func TestWithNodeLabels(t *testing.T) {
+	nodeLabels = []label{{"patroni_role", rolePrimary}}
+	defer func() { nodeLabels = nil }()
+	row := []label{{"datname", "app"}}
+	got := withNodeLabels([]sample{{name: "a", labels: row}, {name: "b", labels: row}})
+	if len(got[0].labels) != 2 || got[1].labels[1].value != rolePrimary || len(row) != 1 {
+		t.Errorf("withNodeLabels() = %+v", got)
+	}
+}
@@ -0,0 +1,212 @@
+package watcher
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// pivotSpec turns key/value rows into one metric per key: the name column becomes
+// the metric name suffix, the value column the sample and the optional unit column
+// (pg_settings.unit style) scales the value to bytes or seconds
+type pivotSpec struct {
+	nameColumn  string
+	valueColumn string
+	unitColumn  string
+	// allLabels makes every other non-NULL column a label, numeric ones included
+	// (metric_column mode for UNION ALL queries with heterogeneous metrics)
+	allLabels bool
+}
+
+// column roles in pivot mode
+const (
+	pivotNone = iota
+	pivotNameCol
+	pivotValueCol
+	pivotUnitCol
+)
+
+// parsePivot parses "name_column, value_column[, unit_column]"
+func parsePivot(s string) (*pivotSpec, error) {
+	cols := splitList(s)
+	if len(cols) < 2 || len(cols) > 3 {
+		return nil, fmt.Errorf("invalid pivot %q: want name_column, value_column[, unit_column]", s)
+	}
+	p := &pivotSpec{nameColumn: cols[0], valueColumn: cols[1]}
+	if len(cols) == 3 {
+		p.unitColumn = cols[2]
+	}
+	return p, nil
+}
+
+// parseMetricColumn parses "name_column, value_column[, unit_column]" for metric_column mode
+func parseMetricColumn(s string) (*pivotSpec, error) {
+	p, err := parsePivot(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metric_column %q: want name_column, value_column[, unit_column]", s)
+	}
+	p.allLabels = true
+	return p, nil
+}
+
+// annotatePivot handles the pivot and metric_column annotations
+func annotatePivot(q *queryDef, key, value string) error {
+	parse := parsePivot
+	if key == "metric_column" {
+		parse = parseMetricColumn
+	}
+	p, err := parse(value)
+	if err != nil {
+		return err
+	}
+	q.pivot = p
+	return nil
+}
+
+// pivotOf returns the pivot setting of the query; the annotation replaces -pivot / -metric-column
+func (q queryDef) pivotOf() *pivotSpec {
+	if q.pivot != nil {
+		return q.pivot
+	}
+	return flagParam.pivot
+}
+
+// columnRole tells which pivot role a column has
+func (p *pivotSpec) columnRole(column string) int {
+	switch {
+	case p == nil:
+		return pivotNone
+	case column == p.nameColumn:
+		return pivotNameCol
+	case column == p.valueColumn:
+		return pivotValueCol
+	case p.unitColumn != "" && column == p.unitColumn:
+		return pivotUnitCol
+	}
+	return pivotNone
+}
+
+// pivotValue accepts numbers, numeric text and boolean settings (on/off, true/false)
+func pivotValue(v any) (float64, bool) {
+	switch x := v.(type) {
+	case bool:
+		if x {
+			return 1, true
+		}
+		return 0, true
+	case string, []byte:
+		s := strings.ToLower(strings.TrimSpace(labelVal(x)))
+		switch s {
+		case "on", "true", "yes":
+			return 1, true
+		case "off", "false", "no":
+			return 0, true
+		}
+	}
+	f, ok := toFloat64(v)
+	if !ok || math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, false
+	}
+	return f, true
+}
+
+// unitValue parses unit-suffixed text as printed by SHOW ("128MB", "5min", "200ms");
+// the unit must be one scalePGUnit knows
+func unitValue(v any) (float64, string, bool) {
+	var s string
+	switch x := v.(type) {
+	case string, []byte:
+		s = strings.TrimSpace(labelVal(x))
+	default:
+		return 0, "", false
+	}
+	i := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != '.' && r != '-' })
+	if i <= 0 {
+		return 0, "", false
+	}
+	f, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil {
+		return 0, "", false
+	}
+	unit := s[i:]
+	if _, base := scalePGUnit(f, unit); base == "" {
+		return 0, "", false
+	}
+	return f, unit, true
+}
+
+// scalePGUnit converts a value in a pg_settings unit (8kB, MB, ms, min, ...)
+// to bytes or seconds. Unknown or empty units leave the value unchanged.
+func scalePGUnit(f float64, unit string) (float64, string) {
+	unit = strings.TrimSpace(unit)
+	// a leading multiplier as in "8kB" or "16MB"
+	mult := 1.0
+	i := 0
+	for i < len(unit) && unit[i] >= '0' && unit[i] <= '9' {
+		i++
+	}
+	if i > 0 {
+		n, err := strconv.Atoi(unit[:i])
+		if err != nil {
+			return f, ""
+		}
+		mult = float64(n)
+	}
+	switch unit[i:] {
+	case "B":
+		return f * mult, "bytes"
+	case "kB":
+		return f * mult * 1024, "bytes"
+	case "MB":
+		return f * mult * 1024 * 1024, "bytes"
+	case "GB":
+		return f * mult * 1024 * 1024 * 1024, "bytes"
+	case "TB":
+		return f * mult * 1024 * 1024 * 1024 * 1024, "bytes"
+	case "us":
+		return f * mult / 1e6, "seconds"
+	case "ms":
+		return f * mult / 1e3, "seconds"
+	case "s":
+		return f * mult, "seconds"
+	case "min":
+		return f * mult * 60, "seconds"
+	case "h":
+		return f * mult * 3600, "seconds"
+	case "d":
+		return f * mult * 86400, "seconds"
+	}
+	return f, ""
+}
+
+// pivotSample builds the sample of one key/value row; rows without a name or with a
+// non-numeric value (enum settings, paths) are skipped. A unit in the value itself
+// (SHOW output like "128MB") takes precedence over the unit column.
+func pivotSample(q queryDef, prefix, dbname string, name, unit string, v any) (sample, bool) {
+	if name == "" {
+		return sample{}, false
+	}
+	f, ok := pivotValue(v)
+	if !ok {
+		var valueUnit string
+		if f, valueUnit, ok = unitValue(v); !ok {
+			return sample{}, false
+		}
+		unit = valueUnit
+	}
+	f, base := scalePGUnit(f, unit)
+	if base == "" {
+		base = unitFor(name)
+	}
+	return sample{
+		name:   normalizeName(prefix + "_" + name),
+		prefix: prefix,
+		column: name,
+		db:     dbname,
+		value:  f,
+		kind:   q.kindOf(name),
+		unit:   base,
+		help:   q.help[name],
+	}, true
+}
@@ -0,0 +1,77 @@
+package watcher
+
+import "testing"
+
+func TestScalePGUnit(t *testing.T) {
+	tests := []struct {
+		value    float64
+		unit     string
+		want     float64
+		wantUnit string
+	}{
+		{4096, "kB", 4194304, "bytes"},
+		{16384, "8kB", 134217728, "bytes"},
+		{1, "16MB", 16777216, "bytes"},
+		{200, "ms", 0.2, "seconds"},
+		{5, "min", 300, "seconds"},
+		{100, "", 100, ""},
+		{3, "xyz", 3, ""},
+	}
+	for _, tt := range tests {
+		got, unit := scalePGUnit(tt.value, tt.unit)
+		if got != tt.want || unit != tt.wantUnit {
+			t.Errorf("scalePGUnit(%v, %q) = %v, %q; want %v, %q", tt.value, tt.unit, got, unit, tt.want, tt.wantUnit)
+		}
+	}
+}
+
+// Test one pg_settings row per metric with scaled units
+func TestPivotSample(t *testing.T) {
+	flagParam = FlagParam{prefixMetric: "pgwatch"}
+	q, err := parseQueryDef("-- name: setting\n-- pivot: name, setting, unit\nselect name, setting, unit from pg_settings")
+	if err != nil {
+		t.Fatalf("parseQueryDef() error = %v", err)
+	}
+	p := q.pivotOf()
+	if p.columnRole("name") != pivotNameCol || p.columnRole("setting") != pivotValueCol || p.columnRole("unit") != pivotUnitCol || p.columnRole("context") != pivotNone {
+		t.Fatalf("pivot = %+v", p)
+	}
+
+	s, ok := pivotSample(q, q.prefix(), "postgres", "work_mem", "kB", "4096")
+	if !ok || s.name != "pgwatch_setting_work_mem" || s.value != 4194304 || s.unit != "bytes" || s.column != "work_mem" {
+		t.Errorf("work_mem = %+v, %v", s, ok)
+	}
+	if s, ok := pivotSample(q, q.prefix(), "postgres", "fsync", "", "on"); !ok || s.value != 1 {
+		t.Errorf("fsync = %+v, %v", s, ok)
+	}
+	if _, ok := pivotSample(q, q.prefix(), "postgres", "wal_level", "", "replica"); ok {
+		t.Error("enum setting was not skipped")
+	}
+	if _, ok := pivotSample(q, q.prefix(), "postgres", "", "", "1"); ok {
+		t.Error("row without name was not skipped")
+	}
+
+	for _, bad := range []string{"name", "a,b,c,d"} {
+		if _, err := parsePivot(bad); err == nil {
+			t.Errorf("parsePivot(%q) expected error", bad)
+		}
+	}
+}
+
+func TestParseMetricColumn(t *testing.T) {
+	flagParam = FlagParam{prefixMetric: "pgwatch", pivot: &pivotSpec{nameColumn: "name", valueColumn: "setting"}}
+	q, err := parseQueryDef("-- metric_column: metric, value\nselect 'lag_bytes' as metric, 1 as value, 'a' as slot union all select 'conflicts', 2, null")
+	if err != nil {
+		t.Fatalf("parseQueryDef() error = %v", err)
+	}
+	p := q.pivotOf()
+	if !p.allLabels || p.nameColumn != "metric" || p.valueColumn != "value" || p.columnRole("slot") != pivotNone {
+		t.Errorf("metric_column = %+v", p)
+	}
+	if plain := (queryDef{}).pivotOf(); plain.allLabels || plain.nameColumn != "name" {
+		t.Errorf("plain query did not inherit -pivot: %+v", plain)
+	}
+	if _, err := parseQueryDef("-- metric_column: metric\nselect 1"); err == nil {
+		t.Error("metric_column with one column expected error")
+	}
+}
@@ -0,0 +1,150 @@
+package watcher
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	poolerPgBouncer = "pgbouncer"
+	poolerOdyssey   = "odyssey"
+)
+
+// poolerAdminDB returns the virtual database of the pooler admin console
+func poolerAdminDB(pooler string) string {
+	if pooler == poolerOdyssey {
+		return "console"
+	}
+	return "pgbouncer"
+}
+
+func parsePooler(s string) (string, error) {
+	switch p := strings.ToLower(strings.TrimSpace(s)); p {
+	case "", poolerPgBouncer, poolerOdyssey:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown pooler %q: want %s or %s", s, poolerPgBouncer, poolerOdyssey)
+	}
+}
+
+// poolerColumn describes a column of an admin console SHOW command
+type poolerColumn struct {
+	label bool // identifying text or numbers (database, user, port, ...)
+	kind  metricKind
+	// unit of the raw value: "us" is converted to seconds, "bytes" is kept
+	unit string
+}
+
+var (
+	pcLabel   = poolerColumn{label: true}
+	pcGauge   = poolerColumn{}
+	pcCounter = poolerColumn{kind: kindCounter}
+)
+
+func pcOf(kind metricKind, unit string) poolerColumn { return poolerColumn{kind: kind, unit: unit} }
+
+// poolerShowColumns lists the columns of the pgbouncer SHOW commands; Odyssey
+// implements the same commands with a subset of the columns
+var poolerShowColumns = map[string]map[string]poolerColumn{
+	"stats": {
+		"database":                      pcLabel,
+		"total_xact_count":              pcCounter,
+		"total_query_count":             pcCounter,
+		"total_server_assignment_count": pcCounter,
+		"total_received":                pcOf(kindCounter, "bytes"),
+		"total_sent":                    pcOf(kindCounter, "bytes"),
+		"total_xact_time":               pcOf(kindCounter, "us"),
+		"total_query_time":              pcOf(kindCounter, "us"),
+		"total_wait_time":               pcOf(kindCounter, "us"),
+		"avg_xact_count":                pcGauge,
+		"avg_query_count":               pcGauge,
+		"avg_server_assignment_count":   pcGauge,
+		"avg_recv":                      pcOf(kindGauge, "bytes"),
+		"avg_sent":                      pcOf(kindGauge, "bytes"),
+		"avg_xact_time":                 pcOf(kindGauge, "us"),
+		"avg_query_time":                pcOf(kindGauge, "us"),
+		"avg_wait_time":                 pcOf(kindGauge, "us"),
+	},
+	"pools": {
+		"database":              pcLabel,
+		"user":                  pcLabel,
+		"pool_mode":             pcLabel,
+		"load_balance_hosts":    pcLabel,
+		"cl_active":             pcGauge,
+		"cl_waiting":            pcGauge,
+		"cl_active_cancel_req":  pcGauge,
+		"cl_waiting_cancel_req": pcGauge,
+		"sv_active":             pcGauge,
+		"sv_active_cancel":      pcGauge,
+		"sv_being_canceled":     pcGauge,
+		"sv_idle":               pcGauge,
+		"sv_used":               pcGauge,
+		"sv_tested":             pcGauge,
+		"sv_login":              pcGauge,
+		"maxwait":               pcOf(kindGauge, "s"),
+		"maxwait_us":            pcGauge, // sub-second part of maxwait
+	},
+	"databases": {
+		"name":                       pcLabel,
+		"host":                       pcLabel,
+		"port":                       pcLabel,
+		"database":                   pcLabel,
+		"force_user":                 pcLabel,
+		"pool_mode":                  pcLabel,
+		"pool_size":                  pcGauge,
+		"min_pool_size":              pcGauge,
+		"reserve_pool":               pcGauge,
+		"server_lifetime":            pcOf(kindGauge, "s"),
+		"max_connections":            pcGauge,
+		"current_connections":        pcGauge,
+		"max_client_connections":     pcGauge,
+		"current_client_connections": pcGauge,
+		"paused":                     pcGauge,
+		"disabled":                   pcGauge,
+	},
+	"mem": {
+		"name":     pcLabel,
+		"size":     pcOf(kindGauge, "bytes"),
+		"used":     pcGauge,
+		"free":     pcGauge,
+		"memtotal": pcOf(kindGauge, "bytes"),
+	},
+}
+
+// poolerShowCommand returns the SHOW command of a query ("stats" for
+// "SHOW STATS;"), or "" if the query is something else
+func poolerShowCommand(sql string) string {
+	var words []string
+	for _, tok := range sqlTokens(sql) {
+		if tok.text != ";" {
+			words = append(words, strings.ToLower(tok.text))
+		}
+	}
+	if len(words) != 2 || words[0] != "show" {
+		return ""
+	}
+	return words[1]
+}
+
+// poolerColumnOf returns the known type of a column of the query in -pooler mode
+func poolerColumnOf(q queryDef, column string) (poolerColumn, bool) {
+	if flagParam.pooler == "" {
+		return poolerColumn{}, false
+	}
+	pc, ok := poolerShowColumns[poolerShowCommand(q.sql)][column]
+	return pc, ok
+}
+
+// apply returns the metric name suffix, unit and scale factor of a pooler column:
+// microsecond and second columns are exported in seconds
+func (pc poolerColumn) apply(column string) (name, unit string, scale float64) {
+	switch pc.unit {
+	case "us":
+		return strings.TrimSuffix(column, "_us") + "_seconds", "seconds", 1e-6
+	case "s":
+		return column + "_seconds", "seconds", 1
+	case "bytes":
+		return column + "_bytes", "bytes", 1
+	}
+	return column, "", 1
+}
@@ -0,0 +1,57 @@
+package watcher
+
+import "testing"
+
+func TestPoolerShowCommand(t *testing.T) {
+	tests := map[string]string{
+		"show stats;":             "stats",
+		"SHOW POOLS":              "pools",
+		"-- name: x\nshow mem ;":  "mem",
+		"select * from pg_stat_a": "",
+		"show":                    "",
+	}
+	for sql, want := range tests {
+		if got := poolerShowCommand(sql); got != want {
+			t.Errorf("poolerShowCommand(%q) = %q, want %q", sql, got, want)
+		}
+	}
+}
+
+// Test known admin console columns get labels, types and units
+func TestPoolerColumns(t *testing.T) {
+	flagParam = FlagParam{}
+	stats := queryDef{sql: "show stats"}
+	if _, ok := poolerColumnOf(stats, "total_xact_time"); ok {
+		t.Error("pooler columns applied without -pooler")
+	}
+
+	flagParam.pooler = poolerPgBouncer
+	pc, ok := poolerColumnOf(stats, "total_xact_time")
+	if !ok || pc.kind != kindCounter {
+		t.Fatalf("total_xact_time = %+v, %v", pc, ok)
+	}
+	if name, unit, scale := pc.apply("total_xact_time"); name != "total_xact_time_seconds" || unit != "seconds" || scale != 1e-6 {
+		t.Errorf("apply() = %q, %q, %v", name, unit, scale)
+	}
+	if pc, _ := poolerColumnOf(stats, "total_received"); pc.kind != kindCounter || pc.unit != "bytes" {
+		t.Errorf("total_received = %+v", pc)
+	}
+	if pc, _ := poolerColumnOf(queryDef{sql: "show databases"}, "port"); !pc.label {
+		t.Error("databases.port is not a label")
+	}
+	if _, ok := poolerColumnOf(queryDef{sql: "show clients"}, "port"); ok {
+		t.Error("unknown command has typed columns")
+	}
+}
+
+func TestParsePooler(t *testing.T) {
+	if p, err := parsePooler("Odyssey"); err != nil || p != poolerOdyssey || poolerAdminDB(p) != "console" {
+		t.Errorf("parsePooler(Odyssey) = %q, %v", p, err)
+	}
+	if poolerAdminDB(poolerPgBouncer) != "pgbouncer" {
+		t.Error("wrong pgbouncer admin database")
+	}
+	if _, err := parsePooler("pgpool"); err == nil {
+		t.Error("parsePooler(pgpool) expected error")
+	}
+}
@@ -0,0 +1,126 @@
+package watcher
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+
+	"gopkg.in/yaml.v3"
+)
+
+// exporterMetric is one column entry of a postgres_exporter queries.yaml query
+type exporterMetric struct {
+	Usage       string `yaml:"usage"`
+	Description string `yaml:"description"`
+}
+
+// exporterQuery is one top-level entry of a postgres_exporter queries.yaml file
+type exporterQuery struct {
+	Query   string                      `yaml:"query"`
+	Master  bool                        `yaml:"master"`
+	Cache   int                         `yaml:"cache_seconds"`
+	Metrics []map[string]exporterMetric `yaml:"metrics"`
+}
+
+// loadQueriesYAML reads a postgres_exporter queries.yaml file. Entries keep
+// their file order; the entry name becomes the query name.
+func loadQueriesYAML(path string) ([]queryDef, error) {
+	content, err := readSourceFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read queries file: %w", err)
+	}
+	return parseQueriesYAML(content)
+}
+
+func parseQueriesYAML(content []byte) ([]queryDef, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(content, &doc); err != nil {
+		return nil, fmt.Errorf("queries yaml: %w", err)
+	}
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("queries yaml: top level must be a mapping of query names")
+	}
+
+	var defs []queryDef
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		name := root.Content[i].Value
+		var eq exporterQuery
+		if err := root.Content[i+1].Decode(&eq); err != nil {
+			return nil, fmt.Errorf("queries yaml: %s: %w", name, err)
+		}
+		q, err := exporterQueryDef(name, &eq)
+		if err != nil {
+			return nil, fmt.Errorf("queries yaml: %s: %w", name, err)
+		}
+		defs = append(defs, q)
+	}
+	return defs, nil
+}
+
+// exporterQueryDef maps column usages: DISCARD → ignored, LABEL → forced label,
+// GAUGE/COUNTER → typed metric; descriptions become HELP text
+func exporterQueryDef(name string, eq *exporterQuery) (queryDef, error) {
+	if strings.TrimSpace(eq.Query) == "" {
+		return queryDef{}, fmt.Errorf("empty query")
+	}
+	// annotations inside the query text still apply (e.g. -- timeout:)
+	q, err := parseQueryDef(eq.Query)
+	if err != nil {
+		return q, err
+	}
+	q.name = name
+	q.masterDBOnly = eq.Master
+	if eq.Cache > 0 {
+		q.minInterval = time.Duration(eq.Cache) * time.Second
+	}
+	if len(eq.Metrics) == 0 {
+		return q, nil // no column list: -labels / -ignoredColumns / -counters apply
+	}
+	q.labels = []string{}
+	q.ignored = map[string]bool{}
+	q.kinds = map[string]metricKind{}
+	q.help = map[string]string{}
+
+	for _, entry := range eq.Metrics {
+		for col, m := range entry {
+			switch strings.ToUpper(m.Usage) {
+			case "DISCARD":
+				q.ignored[col] = true
+			case "LABEL":
+				q.labels = append(q.labels, col)
+			case "GAUGE":
+				q.kinds[col] = kindGauge
+			case "COUNTER":
+				q.kinds[col] = kindCounter
+			default:
+				return q, fmt.Errorf("column %s: usage %q is not supported (use DISCARD, LABEL, GAUGE or COUNTER)", col, m.Usage)
+			}
+			if m.Description != "" {
+				q.help[col] = m.Description
+			}
+		}
+	}
+	return q, nil
+}
+
+// masterDBOf returns the database of postgres_exporter "master: true" queries: the
+// database of the connection string (postgres if it names none), as postgres_exporter
+// does. If that database is not collected (-db-name=all leaves postgres out), the
+// first database by name is used instead.
+func masterDBOf(dbList []string) string {
+	name := "postgres"
+	if cfg, err := pgconn.ParseConfig(connString()); err == nil && cfg.Database != "" {
+		name = cfg.Database
+	}
+	if slices.Contains(dbList, name) {
+		return name
+	}
+	return slices.Min(dbList)
+}
@@ -0,0 +1,106 @@
+package watcher
+
+import "testing"
+
+// Test mapping of postgres_exporter queries.yaml definitions
+func TestParseQueriesYAML(t *testing.T) {
+	content := []byte(`
+pg_replication:
+  query: "SELECT CASE WHEN NOT pg_is_in_recovery() THEN 0 ELSE 1 END AS lag"
+  master: true
+  metrics:
+    - lag:
+        usage: "GAUGE"
+        description: "Replication lag behind master in seconds"
+
+pg_stat_user_tables:
+  query: |
+    -- timeout: 30s
+    SELECT schemaname, relname, seq_scan, n_live_tup, last_vacuum FROM pg_stat_user_tables
+  metrics:
+    - schemaname:
+        usage: "LABEL"
+    - relname:
+        usage: "LABEL"
+    - seq_scan:
+        usage: "COUNTER"
+    - n_live_tup:
+        usage: "GAUGE"
+    - last_vacuum:
+        usage: "DISCARD"
+`)
+	defs, err := parseQueriesYAML(content)
+	if err != nil {
+		t.Fatalf("parseQueriesYAML() error = %v", err)
+	}
+	if len(defs) != 2 || defs[0].name != "pg_replication" || defs[1].name != "pg_stat_user_tables" {
+		t.Fatalf("parseQueriesYAML() = %+v", defs)
+	}
+
+	repl := defs[0]
+	if !repl.masterDBOnly || repl.help["lag"] == "" || repl.kindOf("lag") != kindGauge {
+		t.Errorf("pg_replication mapped wrong: %+v", repl)
+	}
+
+	tables := defs[1]
+	if len(tables.labels) != 2 || tables.labels[0] != "schemaname" {
+		t.Errorf("labels = %v", tables.labels)
+	}
+	if !tables.isIgnored("last_vacuum") || tables.kindOf("seq_scan") != kindCounter {
+		t.Errorf("usage mapping wrong: %+v", tables)
+	}
+	if tables.timeout.String() != "30s" {
+		t.Errorf("annotation in query text not applied: timeout = %v", tables.timeout)
+	}
+}
+
+// Test rejection of unsupported usages and malformed files
+func TestParseQueriesYAMLErrors(t *testing.T) {
+	bad := []string{
+		"q:\n  query: select 1\n  metrics:\n    - a:\n        usage: MAPPEDMETRIC\n",
+		"q:\n  metrics: []\n",
+		"- just a list\n",
+	}
+	for _, c := range bad {
+		if _, err := parseQueriesYAML([]byte(c)); err == nil {
+			t.Errorf("parseQueriesYAML(%q) expected error", c)
+		}
+	}
+}
+
+// Test that master: true queries run in the database of the connection string
+func TestMasterDBOf(t *testing.T) {
+	defer func() { connParam = ConnectionString{} }()
+	tests := []struct {
+		connstr string
+		dbs     []string
+		want    string
+	}{
+		{"host=pg1 dbname=app", []string{"zoo", "app", "billing"}, "app"},
+		{"host=pg1", []string{"app", "postgres"}, "postgres"},
+		{"host=pg1", []string{"zoo", "billing"}, "billing"},
+		{"postgres://u@pg1/billing", []string{"app", "billing"}, "billing"},
+	}
+	for _, tt := range tests {
+		connParam = ConnectionString{connstr: tt.connstr}
+		if got := masterDBOf(tt.dbs); got != tt.want {
+			t.Errorf("masterDBOf(%q, %v) = %q, want %q", tt.connstr, tt.dbs, got, tt.want)
+		}
+	}
+}
+
+// Test postgres_exporter style names with an empty -prefixMetric
+func TestEmptyPrefix(t *testing.T) {
+	defer func() { flagParam = FlagParam{} }()
+	flagParam = FlagParam{}
+	if got := (queryDef{name: "pg_replication"}).prefix(); got != "pg_replication" {
+		t.Errorf("prefix() = %q", got)
+	}
+	if got := prefixedName("cache_age_seconds"); got != "cache_age_seconds" {
+		t.Errorf("prefixedName() = %q", got)
+	}
+	flagParam.prefixMetric = "pgwatch"
+	if got := (queryDef{group: "tables", name: "size"}).prefix(); got != "pgwatch_tables_size" {
+		t.Errorf("prefix() = %q", got)
+	}
+}
@@ -0,0 +1,426 @@
+package watcher
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	rolePrimary = "primary"
+	roleReplica = "replica"
+	// finer replica roles, known with -patroni-url
+	roleStandbyLeader = "standby_leader"
+	roleSyncReplica   = "sync_replica"
+	roleAsyncReplica  = "async_replica"
+)
+
+// queryDef is one SQL statement together with its per-query settings
+type queryDef struct {
+	sql         string
+	timeout     time.Duration            // 0 means -query-timeout
+	group       string                   // file name of the query group in -sql-dir
+	name        string                   // appended to -prefixMetric
+	labels      []string                 // forced label columns; nil means -labels
+	role        string                   // rolePrimary, roleReplica, a finer replica role or "" for any node
+	kinds       map[string]metricKind    // per-column metric types, override -counters
+	ignored     map[string]bool          // excluded columns; nil means -ignoredColumns
+	help        map[string]string        // per-column metric descriptions
+	minInterval time.Duration            // results are reused from cache until they are this old
+	transforms  map[string]transformKind // per-column delta/rate; nil means -delta / -rate
+	resetColumn string                   // counter reset marker column; "" means -reset-column
+	// maxSeries and maxLabelLength override -max-series-per-query / -max-label-length
+	maxSeries      int
+	maxLabelLength int
+	pivot          *pivotSpec // pivot or metric_column mode; nil means -pivot / -metric-column
+	histogram      *histogramSpec
+	json           *jsonSpec            // json expansion; nil means -json / -json-labels
+	arrays         map[string]arrayMode // array expansion; nil means -arrays
+	summary        *summarySpec
+	// masterDBOnly runs the query only in the database of the connection string
+	// (postgres_exporter "master: true"), see masterDBOf
+	masterDBOnly bool
+}
+
+// parseQueryDefs turns raw statements into query definitions
+func parseQueryDefs(texts []string) ([]queryDef, error) {
+	defs := make([]queryDef, 0, len(texts))
+	for _, text := range texts {
+		q, err := parseQueryDef(text)
+		if err != nil {
+			return nil, err
+		}
+		defs = append(defs, q)
+	}
+	return defs, nil
+}
+
+// parseQueryDef reads "-- key: value" annotations from the comment lines that
+// precede the statement. Plain comments are left alone, so the text stays
+// runnable in psql; unknown keys that look like a mistyped annotation are errors.
+func parseQueryDef(text string) (queryDef, error) {
+	q := queryDef{sql: text}
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		body, ok := strings.CutPrefix(line, "--")
+		if !ok {
+			break // annotations end at the first line of SQL
+		}
+		key, value, ok := strings.Cut(body, ":")
+		if !ok {
+			continue
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		apply, known := annotations[key]
+		if !known {
+			if err := unknownAnnotation(key); err != nil {
+				return q, err
+			}
+			continue
+		}
+		if apply == nil {
+			continue
+		}
+		if err := apply(&q, key, value); err != nil {
+			return q, err
+		}
+	}
+	modes := 0
+	for _, set := range []bool{q.pivot != nil, q.histogram != nil, q.summary != nil} {
+		if set {
+			modes++
+		}
+	}
+	if modes > 1 {
+		return q, fmt.Errorf("pivot, metric_column, histogram and summary annotations exclude each other")
+	}
+	return q, nil
+}
+
+// annotationFunc applies one "-- key: value" annotation to a query
+type annotationFunc func(q *queryDef, key, value string) error
+
+// annotations maps annotation keys to their parsers; the output mode annotations
+// live next to their modes in pivot.go, histogram.go, jsonexpand.go and arrays.go.
+// A nil parser marks a directive handled elsewhere.
+var annotations = map[string]annotationFunc{
+	"timeout":          annotateTimeout,
+	"name":             annotateName,
+	"labels":           annotateLabels,
+	"role":             annotateRole,
+	"min_interval":     annotateMinInterval,
+	"delta":            annotateTransform,
+	"rate":             annotateTransform,
+	"reset_column":     annotateResetColumn,
+	"max_series":       annotateLimit,
+	"max_label_length": annotateLimit,
+	"ignore":           annotateIgnore,
+	"type":             annotateType,
+	"pivot":            annotatePivot,
+	"metric_column":    annotatePivot,
+	"histogram":        annotateHistogram,
+	"summary":          annotateSummary,
+	"summary_count":    annotateSummary,
+	"summary_sum":      annotateSummary,
+	"json":             annotateJSON,
+	"json_labels":      annotateJSON,
+	"arrays":           annotateArrays,
+	"include":          nil, // expanded by readSQLFile
+}
+
+// annotationKey matches keys written like annotations: lower case words joined by _ or -
+var annotationKey = regexp.MustCompile(`^[a-z][a-z0-9]*(?:[_-][a-z0-9]+)*$`)
+
+// unknownAnnotation decides about an unknown key: capitalized prose ("-- Note: ...",
+// "-- Name: Replication lag") is ignored, lower case keys that look like a mistyped
+// annotation ("lables", "min-interval") are errors, other lower case words are
+// ignored with a warning
+func unknownAnnotation(key string) error {
+	if !annotationKey.MatchString(key) {
+		return nil
+	}
+	// short words like "note" are too close to real keys to count as typos
+	best, bestDist := "", 3
+	if len(key) <= 4 {
+		bestDist = 2
+	}
+	for known := range annotations {
+		if d := editDistance(strings.ReplaceAll(key, "-", "_"), known); d < bestDist || d == bestDist && known < best {
+			best, bestDist = known, d
+		}
+	}
+	switch {
+	case best != "":
+		return fmt.Errorf("unknown annotation %q, did you mean %q?", key, best)
+	case strings.ContainsAny(key, "_-"):
+		return fmt.Errorf("unknown annotation %q", key)
+	}
+	log.Printf("WARN: ignoring unknown annotation %q", key)
+	return nil
+}
+
+// editDistance is the Levenshtein distance of two short ASCII strings
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func annotateTimeout(q *queryDef, _, value string) error {
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return fmt.Errorf("invalid timeout annotation %q: want a positive duration like 30s", value)
+	}
+	q.timeout = d
+	return nil
+}
+
+func annotateName(q *queryDef, _, value string) error {
+	if value == "" {
+		return fmt.Errorf("empty name annotation")
+	}
+	q.name = value
+	return nil
+}
+
+func annotateLabels(q *queryDef, _, value string) error {
+	q.labels = splitList(value)
+	if q.labels == nil {
+		q.labels = []string{}
+	}
+	return nil
+}
+
+func annotateRole(q *queryDef, _, value string) error {
+	role, err := parseRole(value)
+	if err != nil {
+		return err
+	}
+	q.role = role
+	return nil
+}
+
+func annotateMinInterval(q *queryDef, _, value string) error {
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return fmt.Errorf("invalid min_interval annotation %q: want a positive duration like 10m", value)
+	}
+	q.minInterval = d
+	return nil
+}
+
+// annotateTransform handles delta and rate
+func annotateTransform(q *queryDef, key, value string) error {
+	if q.transforms == nil {
+		q.transforms = make(map[string]transformKind)
+	}
+	kind := transformDelta
+	if key == "rate" {
+		kind = transformRate
+	}
+	for _, col := range splitList(value) {
+		q.transforms[col] = kind
+	}
+	return nil
+}
+
+func annotateResetColumn(q *queryDef, _, value string) error {
+	q.resetColumn = value
+	return nil
+}
+
+// annotateLimit handles max_series and max_label_length
+func annotateLimit(q *queryDef, key, value string) error {
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		return fmt.Errorf("invalid %s annotation %q: want a positive number", key, value)
+	}
+	if key == "max_series" {
+		q.maxSeries = n
+	} else {
+		q.maxLabelLength = n
+	}
+	return nil
+}
+
+func annotateIgnore(q *queryDef, _, value string) error {
+	q.ignored = makeForcedLabelsSet(splitList(value))
+	return nil
+}
+
+func annotateType(q *queryDef, _, value string) error {
+	kinds, err := parseKinds(value)
+	if err != nil {
+		return err
+	}
+	q.kinds = kinds
+	return nil
+}
+
+// parseRole accepts the role spellings used by -master-only / -replica-only and Patroni
+func parseRole(s string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "primary", "master", "leader":
+		return rolePrimary, nil
+	case "replica", "standby":
+		return roleReplica, nil
+	case "standby_leader":
+		return roleStandbyLeader, nil
+	case "sync_replica", "sync_standby", "sync":
+		return roleSyncReplica, nil
+	case "async_replica", "async":
+		return roleAsyncReplica, nil
+	case "", "any":
+		return "", nil
+	default:
+		return "", fmt.Errorf("invalid role annotation %q: want primary, replica, standby_leader, sync_replica, async_replica or any", s)
+	}
+}
+
+// parseKinds parses "col=gauge,col2=counter"
+func parseKinds(s string) (map[string]metricKind, error) {
+	pairs, err := parseKeyValueList(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid type annotation: %w", err)
+	}
+	kinds := make(map[string]metricKind, len(pairs))
+	for col, typ := range pairs {
+		switch strings.ToLower(typ) {
+		case "gauge":
+			kinds[col] = kindGauge
+		case "counter":
+			kinds[col] = kindCounter
+		default:
+			return nil, fmt.Errorf("invalid type %q for column %s: want gauge or counter", typ, col)
+		}
+	}
+	return kinds, nil
+}
+
+// splitList splits a comma-separated list, trimming blanks
+func splitList(s string) []string {
+	var list []string
+	for _, it := range strings.Split(s, ",") {
+		if it = strings.TrimSpace(it); it != "" {
+			list = append(list, it)
+		}
+	}
+	return list
+}
+
+// prefix returns the metric prefix of the query: -prefixMetric, then the group and query names if any
+func (q queryDef) prefix() string {
+	var parts []string
+	for _, part := range []string{flagParam.prefixMetric, q.group, q.name} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, "_")
+}
+
+// prefixedName is <-prefixMetric>_<suffix>; an empty prefix (queries.yaml mode) leaves suffix alone
+func prefixedName(suffix string) string {
+	if flagParam.prefixMetric == "" {
+		return suffix
+	}
+	return flagParam.prefixMetric + "_" + suffix
+}
+
+// forcedLabels returns the label columns of the query
+func (q queryDef) forcedLabels() []string {
+	if q.labels != nil {
+		return q.labels
+	}
+	return flagParam.labelColumnsArr
+}
+
+// id identifies the query text, so cached results are dropped when the SQL changes
+func (q queryDef) id() string {
+	sum := sha256.Sum256([]byte(q.sql))
+	return hex.EncodeToString(sum[:8])
+}
+
+// displayName names the query in self-metrics and logs
+func (q queryDef) displayName() string {
+	switch {
+	case q.group != "" && q.name != "":
+		return q.group + "_" + q.name
+	case q.group != "":
+		return q.group
+	case q.name != "":
+		return q.name
+	}
+	return q.id()
+}
+
+// isIgnored reports whether a column is excluded from the output
+func (q queryDef) isIgnored(column string) bool {
+	if q.ignored != nil {
+		return q.ignored[column]
+	}
+	return flagParam.ignoredColumns[column]
+}
+
+// kindOf returns the metric type of a column
+func (q queryDef) kindOf(column string) metricKind {
+	if k, ok := q.kinds[column]; ok {
+		return k
+	}
+	if flagParam.counterColumns[column] {
+		return kindCounter
+	}
+	return kindGauge
+}
+
+// runsOn reports whether the query should run on a node with the given role
+func (q queryDef) runsOn(role string) bool {
+	if q.role == "" || role == "" || q.role == role {
+		return true
+	}
+	// every finer role from Patroni is a replica
+	return q.role == roleReplica && role != rolePrimary
+}
+
+// effectiveTimeout returns the per-query timeout, falling back to -query-timeout and -pg-timeout
+func (q queryDef) effectiveTimeout() time.Duration {
+	switch {
+	case q.timeout > 0:
+		return q.timeout
+	case flagParam.queryTimeout > 0:
+		return flagParam.queryTimeout
+	default:
+		return flagParam.pgTimeout
+	}
+}
+
+// pgMillis renders a duration as a millisecond value for statement_timeout / lock_timeout
+func pgMillis(d time.Duration) string {
+	ms := d.Milliseconds()
+	if ms < 1 {
+		ms = 1
+	}
+	return fmt.Sprintf("%d", ms)
+}
@@ -0,0 +1,146 @@
+package watcher
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test annotation parsing in leading comments
+func TestParseQueryDef(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		timeout time.Duration
+		wantErr bool
+	}{
+		{"no annotations", "select 1", 0, false},
+		{"timeout", "-- timeout: 30s\nselect 1", 30 * time.Second, false},
+		{"plain comments around", "-- table stats\n  -- timeout: 2m\n\nselect 1", 2 * time.Minute, false},
+		{"capitalized key is a comment", "-- Timeout: 2m\nselect 1", 0, false},
+		{"after sql is ignored", "select 1\n-- timeout: 30s", 0, false},
+		{"invalid duration", "-- timeout: soon\nselect 1", 0, true},
+		{"non-positive duration", "-- timeout: 0s\nselect 1", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := parseQueryDef(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseQueryDef() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && q.timeout != tt.timeout {
+				t.Errorf("parseQueryDef() timeout = %v, want %v", q.timeout, tt.timeout)
+			}
+		})
+	}
+}
+
+// Test timeout fallback chain: annotation, -query-timeout, -pg-timeout
+func TestEffectiveTimeout(t *testing.T) {
+	flagParam = FlagParam{pgTimeout: 5 * time.Second}
+	if got := (queryDef{}).effectiveTimeout(); got != 5*time.Second {
+		t.Errorf("fallback to -pg-timeout = %v", got)
+	}
+	flagParam.queryTimeout = 10 * time.Second
+	if got := (queryDef{}).effectiveTimeout(); got != 10*time.Second {
+		t.Errorf("fallback to -query-timeout = %v", got)
+	}
+	if got := (queryDef{timeout: time.Minute}).effectiveTimeout(); got != time.Minute {
+		t.Errorf("per-query timeout = %v", got)
+	}
+}
+
+// Test millisecond rendering for statement_timeout
+func TestPgMillis(t *testing.T) {
+	tests := []struct {
+		input    time.Duration
+		expected string
+	}{
+		{5 * time.Second, "5000"},
+		{1500 * time.Microsecond, "1"},
+		{time.Microsecond, "1"},
+	}
+	for _, tt := range tests {
+		if got := pgMillis(tt.input); got != tt.expected {
+			t.Errorf("pgMillis(%v) = %q, want %q", tt.input, got, tt.expected)
+		}
+	}
+}
+
+// Test per-query metadata annotations
+func TestParseQueryDefAnnotations(t *testing.T) {
+	text := "-- name: replication_lag\n-- labels: application_name, client_addr\n-- role: standby\n-- type: lag_bytes=gauge, sent=counter\nselect 1"
+	q, err := parseQueryDef(text)
+	if err != nil {
+		t.Fatalf("parseQueryDef() error = %v", err)
+	}
+	if q.name != "replication_lag" || q.role != roleReplica {
+		t.Errorf("name = %q, role = %q", q.name, q.role)
+	}
+	if len(q.labels) != 2 || q.labels[1] != "client_addr" {
+		t.Errorf("labels = %v", q.labels)
+	}
+	if q.kinds["lag_bytes"] != kindGauge || q.kinds["sent"] != kindCounter {
+		t.Errorf("kinds = %v", q.kinds)
+	}
+
+	for _, bad := range []string{"-- role: arbiter\nselect 1", "-- type: a=histogram\nselect 1", "-- name:\nselect 1"} {
+		if _, err := parseQueryDef(bad); err == nil {
+			t.Errorf("parseQueryDef(%q) expected error", bad)
+		}
+	}
+}
+
+// Test fallbacks from annotations to global flags
+func TestQueryDefDefaults(t *testing.T) {
+	flagParam = FlagParam{prefixMetric: "pgwatch", labelColumnsArr: []string{"datname"}, counterColumns: map[string]bool{"calls": true}}
+
+	plain := queryDef{}
+	if plain.prefix() != "pgwatch" || len(plain.forcedLabels()) != 1 || plain.kindOf("calls") != kindCounter {
+		t.Errorf("plain query did not inherit flags")
+	}
+
+	named := queryDef{name: "lag", labels: []string{}, kinds: map[string]metricKind{"calls": kindGauge}}
+	if named.prefix() != "pgwatch_lag" || len(named.forcedLabels()) != 0 || named.kindOf("calls") != kindGauge {
+		t.Errorf("annotations did not override flags")
+	}
+
+	replicaOnly := queryDef{role: roleReplica}
+	if replicaOnly.runsOn(rolePrimary) || !replicaOnly.runsOn(roleReplica) || !plain.runsOn(rolePrimary) {
+		t.Errorf("runsOn() gating is wrong")
+	}
+}
+
+// Test that mistyped annotation keys are rejected and prose comments are not
+func TestParseQueryDefUnknownKeys(t *testing.T) {
+	tests := []struct {
+		input   string
+		wantErr bool
+	}{
+		{"-- lables: a, b\nselect 1", true},
+		{"-- min-interval: 1m\nselect 1", true},
+		{"-- reset_columns: stats_reset\nselect 1", true},
+		{"-- pivot_mode: on\nselect 1", true},
+		{"-- Note: counts are per database\nselect 1", false},
+		{"-- Timeuot: 30s\nselect 1", false},
+		{"-- Summary: replication overview\nselect 1", false},
+		{"-- Type: monitoring query\nselect 1", false},
+		{"-- Role: used by the DBA team\nselect 1", false},
+		{"-- Name: Replication lag\nselect 1", false},
+		{"-- note: counts are per database\nselect 1", false},
+		{"-- see: https://www.postgresql.org/docs/\nselect 1", false},
+		{"-- TODO: add more columns\nselect 1", false},
+		{"-- include: common.sql\nselect 1", false},
+	}
+	for _, tt := range tests {
+		if _, err := parseQueryDef(tt.input); (err != nil) != tt.wantErr {
+			t.Errorf("parseQueryDef(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+		}
+	}
+	if q, _ := parseQueryDef("-- Name: Replication lag\nselect 1"); q.name != "" {
+		t.Errorf("capitalized Name set the metric name %q", q.name)
+	}
+	if _, err := parseQueryDef("-- lables: a\nselect 1"); err == nil || !strings.Contains(err.Error(), `did you mean "labels"`) {
+		t.Errorf("parseQueryDef() error = %v, want a suggestion", err)
+	}
+}
@@ -0,0 +1,293 @@
+package watcher
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	relabelReplace   = "replace"
+	relabelKeep      = "keep"
+	relabelDrop      = "drop"
+	relabelLabelDrop = "labeldrop"
+	relabelLabelKeep = "labelkeep"
+	relabelLabelMap  = "labelmap"
+	relabelHashMod   = "hashmod"
+
+	// metricNameLabel and dbLabel expose the metric name and database to rules
+	metricNameLabel = "__name__"
+	dbLabel         = "db"
+)
+
+// relabelRule is one Prometheus-style relabel config
+type relabelRule struct {
+	SourceLabels []string `yaml:"source_labels"`
+	Separator    *string  `yaml:"separator"`
+	Regex        *string  `yaml:"regex"`
+	TargetLabel  string   `yaml:"target_label"`
+	Replacement  *string  `yaml:"replacement"`
+	Modulus      uint64   `yaml:"modulus"`
+	Action       string   `yaml:"action"`
+
+	re *regexp.Regexp
+}
+
+// loadRelabelConfig reads -relabel-config: a YAML list of rules, optionally
+// under a relabel_configs or metric_relabel_configs key as in prometheus.yml
+func loadRelabelConfig(path string) ([]relabelRule, error) {
+	content, err := readSourceFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read relabel config: %w", err)
+	}
+	return parseRelabelConfig(content)
+}
+
+func parseRelabelConfig(content []byte) ([]relabelRule, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(content, &doc); err != nil {
+		return nil, fmt.Errorf("relabel config: %w", err)
+	}
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+	// unknown keys are errors: a misspelled regex or replacement would
+	// otherwise silently fall back to the defaults
+	dec := yaml.NewDecoder(bytes.NewReader(content))
+	dec.KnownFields(true)
+	var rules []relabelRule
+	if doc.Content[0].Kind == yaml.MappingNode {
+		var wrapped struct {
+			Relabel       []relabelRule `yaml:"relabel_configs"`
+			MetricRelabel []relabelRule `yaml:"metric_relabel_configs"`
+		}
+		if err := dec.Decode(&wrapped); err != nil {
+			return nil, fmt.Errorf("relabel config: %w", err)
+		}
+		rules = append(wrapped.Relabel, wrapped.MetricRelabel...)
+	} else if err := dec.Decode(&rules); err != nil {
+		return nil, fmt.Errorf("relabel config: %w", err)
+	}
+	for i := range rules {
+		if err := rules[i].compile(); err != nil {
+			return nil, fmt.Errorf("relabel config: rule %d: %w", i+1, err)
+		}
+	}
+	return rules, nil
+}
+
+// compile applies Prometheus defaults and validates the rule
+func (r *relabelRule) compile() error {
+	if r.Action == "" {
+		r.Action = relabelReplace
+	}
+	r.Action = strings.ToLower(r.Action)
+	if r.Separator == nil {
+		sep := ";"
+		r.Separator = &sep
+	}
+	if r.Regex == nil {
+		re := "(.*)"
+		r.Regex = &re
+	}
+	if r.Replacement == nil {
+		repl := "$1"
+		r.Replacement = &repl
+	}
+	re, err := regexp.Compile("^(?:" + *r.Regex + ")$")
+	if err != nil {
+		return fmt.Errorf("invalid regex %q: %w", *r.Regex, err)
+	}
+	r.re = re
+
+	switch r.Action {
+	case relabelReplace:
+		if r.TargetLabel == "" {
+			return fmt.Errorf("replace needs target_label")
+		}
+	case relabelHashMod:
+		if r.TargetLabel == "" || r.Modulus == 0 {
+			return fmt.Errorf("hashmod needs target_label and a positive modulus")
+		}
+	case relabelKeep, relabelDrop:
+		if len(r.SourceLabels) == 0 {
+			return fmt.Errorf("%s needs source_labels", r.Action)
+		}
+	case relabelLabelDrop, relabelLabelKeep, relabelLabelMap:
+	default:
+		return fmt.Errorf("unknown action %q", r.Action)
+	}
+	return nil
+}
+
+// relabelSamples applies -relabel-config to every series right before output.
+// Rules see the column labels plus __name__ and db; labels starting with "__"
+// are removed afterwards. Series dropped by a rule or left without a name are not written.
+func relabelSamples(rules []relabelRule, samples []sample) []sample {
+	if len(rules) == 0 {
+		return samples
+	}
+	res := samples[:0:0]
+	for i := range samples {
+		if s, ok := relabelSample(rules, samples[i]); ok {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+func relabelSample(rules []relabelRule, s sample) (sample, bool) {
+	ls := make([]label, 0, len(s.labels)+2)
+	ls = append(ls, label{metricNameLabel, s.name})
+	ls = append(ls, s.labels...)
+	ls = append(ls, label{dbLabel, s.db})
+
+	for i := range rules {
+		var keep bool
+		if ls, keep = rules[i].apply(ls); !keep {
+			return s, false
+		}
+	}
+
+	name, db := s.name, s.db
+	s.labels = nil
+	for _, l := range ls {
+		switch {
+		case l.name == metricNameLabel:
+			name = l.value
+		case l.name == dbLabel:
+			db = l.value
+		case strings.HasPrefix(l.name, "__"):
+		default:
+			s.labels = append(s.labels, l)
+		}
+	}
+	if !hasLabel(ls, metricNameLabel) || name == "" {
+		return s, false
+	}
+	if !hasLabel(ls, dbLabel) {
+		db = ""
+	}
+	if name != s.name {
+		s = renameSample(s, name)
+	}
+	s.db = db
+	return s, true
+}
+
+// renameSample applies a new __name__. Histogram and summary parts that keep their
+// _bucket/_count/_sum suffix rename their family with them, so parts renamed alike
+// stay one distribution; a part that loses its suffix leaves the family as a gauge.
+func renameSample(s sample, name string) sample {
+	if s.family != "" {
+		suffix := strings.TrimPrefix(s.name, s.family)
+		if family, ok := strings.CutSuffix(name, suffix); ok && family != "" {
+			s.name, s.family, s.prefix = name, family, family
+			return s
+		}
+		s.family, s.kind = "", kindGauge
+	}
+	// keep Graphite paths in line with the new name
+	if rest, ok := strings.CutPrefix(name, s.prefix+"_"); ok && s.prefix != "" {
+		s.column = rest
+	} else {
+		s.prefix, s.column = "", name
+	}
+	s.name = name
+	return s
+}
+
+// apply runs one rule; it returns false if the series is to be dropped
+func (r *relabelRule) apply(ls []label) ([]label, bool) {
+	vals := make([]string, len(r.SourceLabels))
+	for i, n := range r.SourceLabels {
+		vals[i] = labelValue(ls, n)
+	}
+	val := strings.Join(vals, *r.Separator)
+
+	switch r.Action {
+	case relabelKeep:
+		return ls, r.re.MatchString(val)
+	case relabelDrop:
+		return ls, !r.re.MatchString(val)
+	case relabelReplace:
+		m := r.re.FindStringSubmatchIndex(val)
+		if m == nil {
+			return ls, true
+		}
+		target := string(r.re.ExpandString(nil, r.TargetLabel, val, m))
+		res := string(r.re.ExpandString(nil, *r.Replacement, val, m))
+		if res == "" {
+			return deleteLabel(ls, target), true
+		}
+		return setLabel(ls, target, res), true
+	case relabelHashMod:
+		sum := md5.Sum([]byte(val))
+		mod := binary.BigEndian.Uint64(sum[8:]) % r.Modulus
+		return setLabel(ls, r.TargetLabel, strconv.FormatUint(mod, 10)), true
+	case relabelLabelMap:
+		res := ls
+		for _, l := range ls {
+			if r.re.MatchString(l.name) {
+				res = setLabel(res, r.re.ReplaceAllString(l.name, *r.Replacement), l.value)
+			}
+		}
+		return res, true
+	case relabelLabelDrop, relabelLabelKeep:
+		res := ls[:0:0]
+		for _, l := range ls {
+			// the metric name is never removed by label filters
+			if l.name == metricNameLabel || r.re.MatchString(l.name) == (r.Action == relabelLabelKeep) {
+				res = append(res, l)
+			}
+		}
+		return res, true
+	}
+	return ls, true
+}
+
+func labelValue(ls []label, name string) string {
+	for _, l := range ls {
+		if l.name == name {
+			return l.value
+		}
+	}
+	return ""
+}
+
+func hasLabel(ls []label, name string) bool {
+	for _, l := range ls {
+		if l.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// setLabel returns a copy of ls with name set to value; new labels are appended
+func setLabel(ls []label, name, value string) []label {
+	res := append([]label(nil), ls...)
+	for i := range res {
+		if res[i].name == name {
+			res[i].value = value
+			return res
+		}
+	}
+	return append(res, label{name, value})
+}
+
+func deleteLabel(ls []label, name string) []label {
+	res := ls[:0:0]
+	for _, l := range ls {
+		if l.name != name {
+			res = append(res, l)
+		}
+	}
+	return res
+}
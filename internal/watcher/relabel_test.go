@@ -0,0 +1,145 @@
+package watcher
+
+import (
+	"strings"
+	"testing"
+)
+
+func relabelRules(t *testing.T, config string) []relabelRule {
+	t.Helper()
+	rules, err := parseRelabelConfig([]byte(config))
+	if err != nil {
+		t.Fatalf("parseRelabelConfig() error = %v", err)
+	}
+	return rules
+}
+
+func promText(samples []sample) string {
+	var b strings.Builder
+	for i := range samples {
+		formatPromLine(&b, &samples[i])
+	}
+	return b.String()
+}
+
+// Test relabel actions on collected series
+func TestRelabelSamples(t *testing.T) {
+	in := []sample{
+		{name: "pgwatch_size", prefix: "pgwatch", column: "size", db: "app", value: 1,
+			labels: []label{{"schemaname", "public"}, {"relname", "orders"}}},
+		{name: "pgwatch_size", prefix: "pgwatch", column: "size", db: "app", value: 2,
+			labels: []label{{"schemaname", "pg_toast"}, {"relname", "t1"}}},
+		{name: "pgwatch_debug", prefix: "pgwatch", column: "debug", db: "app", value: 3},
+	}
+	tests := []struct {
+		name   string
+		config string
+		want   string
+	}{
+		{"no rules", "[]", promText(in)},
+		{"drop by label", `
+- source_labels: [schemaname]
+  regex: pg_toast
+  action: drop
+- source_labels: [__name__]
+  regex: .*_debug
+  action: drop`, `pgwatch_size{schemaname="public",relname="orders",db="app"} 1
+`},
+		{"keep by name", `
+relabel_configs:
+  - source_labels: [__name__]
+    regex: pgwatch_debug
+    action: keep`, `pgwatch_debug{db="app"} 3
+`},
+		{"rename and merge", `
+- source_labels: [__name__]
+  regex: pgwatch_(.*)
+  target_label: __name__
+  replacement: team_$1
+- source_labels: [schemaname, relname]
+  separator: .
+  target_label: table
+- action: labeldrop
+  regex: schemaname|relname`, `team_size{table="public.orders",db="app"} 1
+team_size{table="pg_toast.t1",db="app"} 2
+team_debug{table=".",db="app"} 3
+`},
+		{"labelmap and hashmod", `
+- action: labelmap
+  regex: (schema)name
+  replacement: $1
+- source_labels: [relname]
+  target_label: shard
+  modulus: 1
+  action: hashmod
+- action: labelkeep
+  regex: schema|shard|db`, `pgwatch_size{schema="public",shard="0",db="app"} 1
+pgwatch_size{schema="pg_toast",shard="0",db="app"} 2
+pgwatch_debug{shard="0",db="app"} 3
+`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := promText(relabelSamples(relabelRules(t, tt.config), in))
+			if got != tt.want {
+				t.Errorf("relabelSamples() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+	if in[0].labels[0].value != "public" || in[0].name != "pgwatch_size" {
+		t.Error("relabelSamples() modified its input")
+	}
+}
+
+// Test renamed metrics keep Graphite paths consistent
+func TestRelabelRenameColumn(t *testing.T) {
+	rules := relabelRules(t, "- {source_labels: [__name__], regex: pgwatch_size, target_label: __name__, replacement: pgwatch_table_bytes}")
+	got := relabelSamples(rules, []sample{{name: "pgwatch_size", prefix: "pgwatch", column: "size", db: "app"}})
+	if len(got) != 1 || got[0].column != "table_bytes" || got[0].prefix != "pgwatch" {
+		t.Errorf("relabelSamples() = %+v", got)
+	}
+}
+
+// Test renaming histogram and summary parts keeps their family consistent
+func TestRelabelRenameDistribution(t *testing.T) {
+	base := sample{family: "pgwatch_lat", prefix: "pgwatch_lat", db: "app", kind: kindHistogram}
+	parts := []sample{base, base, base}
+	parts[0].name, parts[0].column, parts[0].labels = "pgwatch_lat_bucket", "bucket", []label{{"le", "+Inf"}}
+	parts[1].name, parts[1].column = "pgwatch_lat_count", "count"
+	parts[2].name, parts[2].column = "pgwatch_lat_sum", "sum"
+
+	rules := relabelRules(t, "- {source_labels: [__name__], regex: 'pgwatch_lat(.*)', target_label: __name__, replacement: 'pg_latency_seconds$1'}")
+	for _, s := range relabelSamples(rules, parts) {
+		if s.family != "pg_latency_seconds" || s.kind != kindHistogram || s.column == "" ||
+			!strings.HasPrefix(s.name, s.family+"_") {
+			t.Errorf("renamed part = %+v", s)
+		}
+	}
+
+	// a part renamed without its suffix leaves the distribution
+	rules = relabelRules(t, "- {source_labels: [__name__], regex: pgwatch_lat_count, target_label: __name__, replacement: pgwatch_lat_total}")
+	got := relabelSamples(rules, parts)
+	if got[1].family != "" || got[1].kind != kindGauge || got[1].name != "pgwatch_lat_total" {
+		t.Errorf("part without suffix = %+v", got[1])
+	}
+	if got[0].family != "pgwatch_lat" || got[2].family != "pgwatch_lat" {
+		t.Errorf("other parts changed: %+v", got)
+	}
+}
+
+func TestParseRelabelConfigErrors(t *testing.T) {
+	for _, bad := range []string{
+		"- action: replace",
+		"- {action: hashmod, target_label: x}",
+		"- {action: keep}",
+		"- {action: rewrite, source_labels: [a]}",
+		"- {source_labels: [a], regex: '(', target_label: b}",
+		"not: [valid",
+		"- {source_labels: [a], regx: 'x.*', action: drop}",
+		"relabel_configs:\n  - {source_labels: [a], action: drop, replacment: x}",
+	} {
+		if _, err := parseRelabelConfig([]byte(bad)); err == nil {
+			t.Errorf("parseRelabelConfig(%q) expected error", bad)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package watcher
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"os/signal"
+	"slices"
+	"syscall"
+	"time"
+)
+
+// sourceFiles lists the files (and -sql-dir directories) the current queries
+// and -relabel-config were loaded from; loadQueries resets it
+var sourceFiles []string
+
+// readSourceFile reads a query source file and remembers it for change detection
+func readSourceFile(path string) ([]byte, error) {
+	sourceFiles = append(sourceFiles, path)
+	return os.ReadFile(path)
+}
+
+// fileStamp identifies one version of a file
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+	missing bool
+}
+
+// sourceState maps every watched path to the stamp it had when queries were loaded
+type sourceState map[string]fileStamp
+
+func snapshotSources() sourceState {
+	st := make(sourceState, len(sourceFiles))
+	for _, p := range sourceFiles {
+		st[p] = statFile(p)
+	}
+	return st
+}
+
+func statFile(path string) fileStamp {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{missing: true}
+	}
+	return fileStamp{modTime: fi.ModTime(), size: fi.Size()}
+}
+
+// changed reports whether any watched file was modified, added or removed
+func (s sourceState) changed() bool {
+	for p, old := range s {
+		if statFile(p) != old {
+			return true
+		}
+	}
+	return false
+}
+
+// validateQueries checks a freshly loaded query set before it is used
+func validateQueries(queries []queryDef) error {
+	if len(queries) == 0 {
+		return errors.New("no queries to run")
+	}
+	if flagParam.sqlCheck {
+		return checkQueries(queries)
+	}
+	return nil
+}
+
+// reloadQueries re-parses all query sources and -relabel-config and swaps them
+// in only if they are all valid; on error the previous set stays in place
+func reloadQueries() error {
+	prevQueries, prevFiles := flagParam.queries, sourceFiles
+	queries, err := loadQueries()
+	if err == nil {
+		err = validateQueries(queries)
+	}
+	var rules []relabelRule
+	if err == nil && flagParam.relabelConfig != "" {
+		rules, err = loadRelabelConfig(flagParam.relabelConfig)
+	}
+	if err != nil {
+		// keep watching the files of the failed attempt as well: a broken file
+		// that was just added must trigger another reload once it is fixed
+		for _, p := range prevFiles {
+			if !slices.Contains(sourceFiles, p) {
+				sourceFiles = append(sourceFiles, p)
+			}
+		}
+		flagParam.queries = prevQueries
+		return err
+	}
+	flagParam.queries = queries
+	if flagParam.relabelConfig != "" {
+		flagParam.relabel = rules
+	}
+	return nil
+}
+
+// runResident collects every -interval until ctx is canceled. Query sources are
+// re-read when a watched file changes or on SIGHUP. Reloads happen between
+// collections, so a cycle always runs with one consistent query set.
+func runResident(ctx context.Context) error {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	state := snapshotSources()
+	ticker := time.NewTicker(flagParam.interval)
+	defer ticker.Stop()
+
+	reload := func(reason string) {
+		if err := reloadQueries(); err != nil {
+			log.Printf("reload (%s) failed, keeping %d previous queries: %v", reason, len(flagParam.queries), err)
+		} else {
+			log.Printf("reload (%s): %d queries loaded", reason, len(flagParam.queries))
+		}
+		// remember the current file versions either way, so a broken file is
+		// reported once and retried when it changes again
+		state = snapshotSources()
+	}
+
+	for {
+		refreshPassword()
+		if err := runOnce(ctx); err != nil {
+			log.Printf("collection: %v", err)
+		}
+	wait:
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-hup:
+				reload("SIGHUP")
+			case <-ticker.C:
+				if state.changed() {
+					reload("files changed")
+				}
+				break wait
+			}
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package watcher
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// Test change detection and atomic swap of reloaded queries
+func TestReloadQueries(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "q.sql")
+	writeFile(t, path, "select 1")
+
+	flagParam = FlagParam{sqlFile: path, SQLSpliter: ";"}
+	queries, err := loadQueries()
+	if err != nil {
+		t.Fatalf("loadQueries() error = %v", err)
+	}
+	flagParam.queries = queries
+	state := snapshotSources()
+	if state.changed() {
+		t.Fatal("changed() = true right after snapshot")
+	}
+
+	// an invalid definition is rejected and the old set is kept
+	writeFile(t, path, "-- timeout: never\nselect 2")
+	if !state.changed() {
+		t.Fatal("changed() = false after rewrite")
+	}
+	if err := reloadQueries(); err == nil {
+		t.Fatal("reloadQueries() accepted an invalid annotation")
+	}
+	if len(flagParam.queries) != 1 || flagParam.queries[0].sql != "select 1" {
+		t.Errorf("queries after failed reload = %+v", flagParam.queries)
+	}
+
+	// a valid definition is swapped in
+	writeFile(t, path, "select 2; select 3;")
+	if err := reloadQueries(); err != nil {
+		t.Fatalf("reloadQueries() error = %v", err)
+	}
+	if len(flagParam.queries) != 2 {
+		t.Errorf("queries after reload = %+v", flagParam.queries)
+	}
+}
+
+// Test that -sql-check and empty sets fail validation
+func TestValidateQueries(t *testing.T) {
+	flagParam = FlagParam{sqlCheck: true}
+	if err := validateQueries(nil); err == nil {
+		t.Error("empty query set accepted")
+	}
+	if err := validateQueries([]queryDef{{sql: "delete from t"}}); err == nil {
+		t.Error("DML accepted with -sql-check")
+	}
+	if err := validateQueries([]queryDef{{sql: "select 1"}}); err != nil {
+		t.Errorf("validateQueries() error = %v", err)
+	}
+}
+
+// Test that a broken file added to -sql-dir stays watched after the failed reload
+func TestReloadQueriesWatchesFailedFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "a.sql"), "select 1")
+	flagParam = FlagParam{sqlDir: dir, SQLSpliter: ";"}
+	queries, err := loadQueries()
+	if err != nil {
+		t.Fatalf("loadQueries() error = %v", err)
+	}
+	flagParam.queries = queries
+
+	added := filepath.Join(dir, "b.sql")
+	writeFile(t, added, "-- timeout: never\nselect 2")
+	if err := reloadQueries(); err == nil {
+		t.Fatal("reloadQueries() accepted an invalid annotation")
+	}
+	state := snapshotSources()
+	if _, ok := state[added]; !ok {
+		t.Fatalf("failed file is not watched: %v", state)
+	}
+
+	writeFile(t, added, "-- timeout: 5s\nselect 2")
+	if !state.changed() {
+		t.Fatal("fixing the added file is not detected")
+	}
+	if err := reloadQueries(); err != nil || len(flagParam.queries) != 2 {
+		t.Errorf("reloadQueries() = %d queries, %v", len(flagParam.queries), err)
+	}
+}
+
+// Test that -relabel-config is re-read with the query sources
+func TestReloadRelabelConfig(t *testing.T) {
+	dir := t.TempDir()
+	sqlPath, relabelPath := filepath.Join(dir, "q.sql"), filepath.Join(dir, "relabel.yml")
+	writeFile(t, sqlPath, "select 1")
+	writeFile(t, relabelPath, "- {source_labels: [__name__], regex: a, action: drop}\n")
+	flagParam = FlagParam{sqlFile: sqlPath, SQLSpliter: ";", relabelConfig: relabelPath}
+	if err := reloadQueries(); err != nil || len(flagParam.relabel) != 1 {
+		t.Fatalf("reloadQueries() = %d rules, %v", len(flagParam.relabel), err)
+	}
+	state := snapshotSources()
+	if _, ok := state[relabelPath]; !ok {
+		t.Fatalf("relabel config is not watched: %v", state)
+	}
+
+	writeFile(t, relabelPath, "- {action: bogus}\n")
+	if err := reloadQueries(); err == nil || len(flagParam.relabel) != 1 {
+		t.Errorf("broken relabel config: rules = %d, err = %v", len(flagParam.relabel), err)
+	}
+	writeFile(t, relabelPath, "- {source_labels: [__name__], regex: a, action: drop}\n- {target_label: env, replacement: prod}\n")
+	if err := reloadQueries(); err != nil || len(flagParam.relabel) != 2 {
+		t.Errorf("reloadQueries() = %d rules, %v", len(flagParam.relabel), err)
+	}
+}
@@ -0,0 +1,115 @@
+package watcher
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// minSecretLen keeps very short passwords from masking unrelated text in logs;
+// password= and URL passwords are masked regardless of length
+const minSecretLen = 4
+
+var (
+	secretsMu sync.Mutex
+	// secrets are the passwords in use, masked wherever they appear
+	secrets []string
+)
+
+var (
+	keywordPassword = regexp.MustCompile(`(?i)(\b(?:ssl)?password\s*=\s*)('(?:[^'\\]|\\.)*'|\S+)`)
+	urlPassword     = regexp.MustCompile(`(?i)(postgres(?:ql)?://[^:/@\s]*:)([^@\s]*)(@)`)
+)
+
+// addSecret registers a password for redaction
+func addSecret(s string) {
+	if len(s) < minSecretLen {
+		return
+	}
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	for _, known := range secrets {
+		if known == s {
+			return
+		}
+	}
+	secrets = append(secrets, s)
+}
+
+// Redact masks passwords in a message: password=... settings, the password of
+// postgres:// URLs and every password pg_watcher has seen
+func Redact(s string) string {
+	s = keywordPassword.ReplaceAllString(s, "${1}xxxxx")
+	s = urlPassword.ReplaceAllString(s, "${1}xxxxx${3}")
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	for _, secret := range secrets {
+		s = strings.ReplaceAll(s, secret, "xxxxx")
+	}
+	return s
+}
+
+// redactWriter is the log output: every line goes through Redact
+type redactWriter struct {
+	w io.Writer
+}
+
+func (r redactWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(r.w, Redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// resolveConnString returns the connection string from -conn-file or -conn-env,
+// falling back to -conn
+func resolveConnString(conn, file, env string) (string, error) {
+	switch {
+	case file != "":
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(content)), nil
+	case env != "":
+		v := strings.TrimSpace(os.Getenv(env))
+		if v == "" {
+			return "", fmt.Errorf("environment variable %s is not set", env)
+		}
+		return v, nil
+	}
+	return conn, nil
+}
+
+// readPasswordFile reads -password-file; only the trailing newline is stripped,
+// spaces may be part of the password
+func readPasswordFile(path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	pw := strings.TrimRight(string(content), "\r\n")
+	if pw == "" {
+		return "", fmt.Errorf("%s is empty", path)
+	}
+	addSecret(pw)
+	return pw, nil
+}
+
+// refreshPassword re-reads -password-file so rotated passwords apply without a
+// restart; on error the previous password stays in use
+func refreshPassword() {
+	if flagParam.passwordFile == "" {
+		return
+	}
+	pw, err := readPasswordFile(flagParam.passwordFile)
+	if err != nil {
+		log.Printf("password file: %v; keeping the previous password", err)
+		return
+	}
+	connParam.password = pw
+}
@@ -0,0 +1,94 @@
+package watcher
+
+import (
+	"fmt"
+	"strings"
+)
+
+// dataModifying are keywords that make a statement write, wherever they appear
+var dataModifying = map[string]bool{
+	"INSERT": true, "UPDATE": true, "DELETE": true, "MERGE": true,
+}
+
+// checkReadOnlySQL accepts only SELECT, SHOW, TABLE and WITH ... SELECT statements
+func checkReadOnlySQL(text string) error {
+	toks := sqlTokens(text)
+	var stmt []sqlToken
+	n := 0
+	for i := 0; i <= len(toks); i++ {
+		if i < len(toks) && !(toks[i].text == ";" && toks[i].depth == 0) {
+			stmt = append(stmt, toks[i])
+			continue
+		}
+		if len(stmt) > 0 {
+			n++
+			if n > 1 {
+				return fmt.Errorf("multiple statements in one query")
+			}
+			if err := checkStatement(stmt); err != nil {
+				return err
+			}
+		}
+		stmt = stmt[:0]
+	}
+	return nil
+}
+
+func checkStatement(toks []sqlToken) error {
+	// skip a leading "(" of a parenthesized select
+	first := 0
+	for first < len(toks) && toks[first].text == "(" {
+		first++
+	}
+	if first == len(toks) {
+		return nil
+	}
+	switch kw := toks[first].text; kw {
+	case "SELECT", "TABLE":
+		for _, t := range toks[first+1:] {
+			if t.text == "INTO" && t.depth == toks[first].depth {
+				return fmt.Errorf("SELECT ... INTO creates a table")
+			}
+		}
+		return nil
+	case "SHOW":
+		return nil
+	case "WITH":
+		for _, t := range toks {
+			if dataModifying[t.text] {
+				return fmt.Errorf("data-modifying %s inside WITH", t.text)
+			}
+		}
+		// the first top-level statement keyword after the CTE list decides
+		for _, t := range toks[first+1:] {
+			if t.depth != toks[first].depth {
+				continue
+			}
+			if t.text == "SELECT" || t.text == "TABLE" {
+				return nil
+			}
+		}
+		return fmt.Errorf("WITH without a final SELECT")
+	default:
+		return fmt.Errorf("%s statements are not allowed", kw)
+	}
+}
+
+// checkQueries validates every query for -sql-check and names the offending one
+func checkQueries(queries []queryDef) error {
+	for i, q := range queries {
+		if err := checkReadOnlySQL(q.sql); err != nil {
+			return fmt.Errorf("-sql-check rejected statement %d (%v): %s", i+1, err, sqlSnippet(q.sql))
+		}
+	}
+	return nil
+}
+
+// sqlSnippet collapses whitespace and shortens SQL for error messages
+func sqlSnippet(text string) string {
+	s := strings.Join(strings.Fields(text), " ")
+	if len(s) > 80 {
+		s = s[:77] + "..."
+	}
+	return s
+}
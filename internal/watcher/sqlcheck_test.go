@@ -0,0 +1,52 @@
+package watcher
+
+import (
+	"strings"
+	"testing"
+)
+
+// Test read-only statement classification for -sql-check
+func TestCheckReadOnlySQL(t *testing.T) {
+	tests := []struct {
+		name    string
+		sql     string
+		wantErr bool
+	}{
+		{"select", "select datname from pg_stat_database", false},
+		{"select with semicolon", "select 1;", false},
+		{"annotated", "-- timeout: 5s\nselect 1", false},
+		{"show", "show pools", false},
+		{"table", "TABLE pg_stat_activity", false},
+		{"parenthesized", "(select 1) union (select 2)", false},
+		{"with select", "with t as (select 1 as a) select a from t", false},
+		{"keyword in literal", "select 'drop table x' as q", false},
+		{"empty", "  -- only a comment\n", false},
+		{"delete", "delete from t", true},
+		{"update", "UPDATE t SET a = 1", true},
+		{"select into", "select * into t2 from t", true},
+		{"with delete", "with d as (delete from t returning *) select * from d", true},
+		{"with values", "with t as (select 1) values (1)", true},
+		{"multiple statements", "select 1; drop table t", true},
+		{"create", "create table t (a int)", true},
+		{"do block", "do $$ begin perform 1; end $$", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkReadOnlySQL(tt.sql)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkReadOnlySQL(%q) error = %v, wantErr %v", tt.sql, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// Test that the error names the offending statement
+func TestCheckQueries(t *testing.T) {
+	err := checkQueries([]queryDef{{sql: "select 1"}, {sql: "truncate   pg_stat_statements"}})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if !strings.Contains(err.Error(), "statement 2") || !strings.Contains(err.Error(), "truncate pg_stat_statements") {
+		t.Errorf("error = %v", err)
+	}
+}
@@ -0,0 +1,183 @@
+package watcher
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// maxIncludeDepth guards against runaway include chains
+const maxIncludeDepth = 10
+
+// loadQueries builds the query list from -sql-cmd, -sql-file, -sql-dir or -queries-yaml
+func loadQueries() ([]queryDef, error) {
+	sourceFiles = nil
+	switch {
+	case flagParam.sqlCmd != "":
+		return parseQueryDefs(splitIfRequested(flagParam.sqlCmd, flagParam.SQLSpliter))
+	case flagParam.sqlFile != "":
+		text, err := readSQLFile(flagParam.sqlFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read SQL file: %w", err)
+		}
+		return parseQueryDefs(splitIfRequested(text, flagParam.SQLSpliter))
+	case flagParam.sqlDir != "":
+		return loadSQLDir(flagParam.sqlDir)
+	case flagParam.queriesYAML != "":
+		return loadQueriesYAML(flagParam.queriesYAML)
+	}
+	return nil, nil
+}
+
+// splitIfRequested splits only when -SQLSpliter is set; otherwise the text is one query
+func splitIfRequested(text, delim string) []string {
+	if delim == "" {
+		return []string{text}
+	}
+	return splitStatements(text, delim)
+}
+
+// sqlDirFiles resolves -sql-dir: a directory means its top-level *.sql files,
+// anything with glob characters is used as a pattern. Files starting with "_"
+// are include-only snippets and are not loaded as groups.
+func sqlDirFiles(pattern string) ([]string, error) {
+	if !strings.ContainsAny(pattern, "*?[") {
+		st, err := os.Stat(pattern)
+		if err != nil {
+			return nil, err
+		}
+		if !st.IsDir() {
+			return nil, fmt.Errorf("%s is not a directory", pattern)
+		}
+		pattern = filepath.Join(pattern, "*.sql")
+	}
+	// the directory itself is watched so added or removed files trigger a reload
+	sourceFiles = append(sourceFiles, filepath.Dir(pattern))
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("bad -sql-dir pattern %q: %w", pattern, err)
+	}
+	var files []string
+	for _, m := range matches {
+		if strings.HasPrefix(filepath.Base(m), "_") {
+			continue
+		}
+		if st, err := os.Stat(m); err == nil && st.Mode().IsRegular() {
+			files = append(files, m)
+		}
+	}
+	sort.Strings(files)
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no SQL files match %s", pattern)
+	}
+	return files, nil
+}
+
+// loadSQLDir loads every file as a query group named after the file. Statements
+// are split on ";" unless -SQLSpliter says otherwise.
+func loadSQLDir(pattern string) ([]queryDef, error) {
+	files, err := sqlDirFiles(pattern)
+	if err != nil {
+		return nil, err
+	}
+	delim := flagParam.SQLSpliter
+	if delim == "" {
+		delim = ";"
+	}
+	var all []queryDef
+	for _, f := range files {
+		text, err := readSQLFile(f)
+		if err != nil {
+			return nil, err
+		}
+		defs, err := parseQueryDefs(splitStatements(text, delim))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", f, err)
+		}
+		group := normalizeName(strings.TrimSuffix(filepath.Base(f), filepath.Ext(f)))
+		for i := range defs {
+			defs[i].group = group
+		}
+		all = append(all, defs...)
+	}
+	return all, nil
+}
+
+// readSQLFile reads a SQL file and expands "-- include: path" lines with the
+// content of path, resolved relative to the including file. Only a line comment
+// on a line of its own counts; the directive inside string literals,
+// dollar-quoted bodies or block comments is left alone.
+func readSQLFile(path string) (string, error) {
+	return expandIncludes(path, nil)
+}
+
+func expandIncludes(path string, stack []string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	for _, p := range stack {
+		if p == abs {
+			return "", fmt.Errorf("include cycle: %s", strings.Join(append(stack, abs), " -> "))
+		}
+	}
+	if len(stack) >= maxIncludeDepth {
+		return "", fmt.Errorf("includes nested deeper than %d at %s", maxIncludeDepth, path)
+	}
+	content, err := readSourceFile(path)
+	if err != nil {
+		return "", err
+	}
+	stack = append(stack, abs)
+
+	text := string(content)
+	var b strings.Builder
+	done := 0 // text before done is written to b
+	for i := 0; i < len(text); {
+		end, comment := skipNonCode(text, i)
+		if end == i {
+			i++
+			continue
+		}
+		lineStart := strings.LastIndexByte(text[:i], '\n') + 1
+		target, ok := "", false
+		if comment && strings.HasPrefix(text[i:], "--") && strings.TrimSpace(text[lineStart:i]) == "" {
+			target, ok = includeTarget(text[i:end])
+		}
+		if !ok {
+			i = end
+			continue
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(path), target)
+		}
+		included, err := expandIncludes(target, stack)
+		if err != nil {
+			return "", fmt.Errorf("%s:%d: %w", path, strings.Count(text[:i], "\n")+1, err)
+		}
+		b.WriteString(text[done:lineStart])
+		b.WriteString(included)
+		if !strings.HasSuffix(included, "\n") {
+			b.WriteByte('\n')
+		}
+		i, done = end, end
+	}
+	b.WriteString(text[done:])
+	return b.String(), nil
+}
+
+// includeTarget recognizes a "-- include: path" line comment
+func includeTarget(line string) (string, bool) {
+	body, ok := strings.CutPrefix(strings.TrimSpace(line), "--")
+	if !ok {
+		return "", false
+	}
+	key, value, ok := strings.Cut(body, ":")
+	if !ok || !strings.EqualFold(strings.TrimSpace(key), "include") {
+		return "", false
+	}
+	value = strings.TrimSpace(value)
+	return value, value != ""
+}
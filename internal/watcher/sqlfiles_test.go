@@ -0,0 +1,95 @@
+package watcher
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Test loading a directory of query groups with includes
+func TestLoadSQLDir(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "common", "filter.sql"), "where schemaname <> 'pg_catalog'")
+	writeFile(t, filepath.Join(dir, "_snippet.sql"), "select 1")
+	writeFile(t, filepath.Join(dir, "tables.sql"),
+		"-- name: size\nselect relname, n_live_tup from pg_stat_user_tables\n-- include: common/filter.sql\n;\nselect 2;")
+	writeFile(t, filepath.Join(dir, "Replication-Lag.sql"), "select 3")
+	writeFile(t, filepath.Join(dir, "notes.txt"), "ignored")
+
+	flagParam = FlagParam{prefixMetric: "pgwatch"}
+	queries, err := loadSQLDir(dir)
+	if err != nil {
+		t.Fatalf("loadSQLDir() error = %v", err)
+	}
+	if len(queries) != 3 {
+		t.Fatalf("loadSQLDir() returned %d queries, want 3", len(queries))
+	}
+	if queries[0].prefix() != "pgwatch_replication_lag" {
+		t.Errorf("queries[0].prefix() = %q", queries[0].prefix())
+	}
+	if queries[1].prefix() != "pgwatch_tables_size" || !strings.Contains(queries[1].sql, "where schemaname <> 'pg_catalog'") {
+		t.Errorf("queries[1] = %+v (prefix %q)", queries[1], queries[1].prefix())
+	}
+	if queries[2].prefix() != "pgwatch_tables" {
+		t.Errorf("queries[2].prefix() = %q", queries[2].prefix())
+	}
+
+	// glob patterns select a subset
+	queries, err = loadSQLDir(filepath.Join(dir, "tab*.sql"))
+	if err != nil || len(queries) != 2 {
+		t.Errorf("glob load = %d queries, err %v", len(queries), err)
+	}
+}
+
+// Test include error reporting
+func TestReadSQLFileIncludeErrors(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "a.sql"), "-- include: b.sql\n")
+	writeFile(t, filepath.Join(dir, "b.sql"), "-- include: a.sql\n")
+	writeFile(t, filepath.Join(dir, "missing.sql"), "select 1\n-- include: nope.sql\n")
+
+	if _, err := readSQLFile(filepath.Join(dir, "a.sql")); err == nil || !strings.Contains(err.Error(), "include cycle") {
+		t.Errorf("cycle error = %v", err)
+	}
+	if _, err := readSQLFile(filepath.Join(dir, "missing.sql")); err == nil || !strings.Contains(err.Error(), "missing.sql:2") {
+		t.Errorf("missing include error = %v", err)
+	}
+	if _, err := sqlDirFiles(filepath.Join(dir, "*.none")); err == nil {
+		t.Error("expected error for pattern without matches")
+	}
+}
+
+// Test that includes are only expanded from top-level line comments
+func TestReadSQLFileIncludeContext(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "inc.sql"), "where true")
+	writeFile(t, filepath.Join(dir, "q.sql"), strings.Join([]string{
+		"select 'a\n-- include: inc.sql\n' as s;",
+		"select $body$\n-- include: inc.sql\n$body$;",
+		"/* example:\n-- include: inc.sql\n*/",
+		"select 1 -- include: inc.sql",
+		"select 2\n  -- include: inc.sql",
+		";",
+	}, "\n"))
+	text, err := readSQLFile(filepath.Join(dir, "q.sql"))
+	if err != nil {
+		t.Fatalf("readSQLFile() error = %v", err)
+	}
+	if got := strings.Count(text, "where true"); got != 1 {
+		t.Errorf("include expanded %d times, want 1:\n%s", got, text)
+	}
+	if !strings.Contains(text, "select 2\nwhere true\n;") {
+		t.Errorf("top-level include not expanded in place:\n%s", text)
+	}
+}
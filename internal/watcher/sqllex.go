@@ -0,0 +1,230 @@
+package watcher
+
+import "strings"
+
+// sqlToken is a lexical token that matters for statement classification:
+// an upper-cased keyword/identifier, or one of "(", ")" and ";"
+type sqlToken struct {
+	text  string
+	depth int // parenthesis depth the token appears at
+}
+
+// sqlTokens scans SQL text and returns bare words and structural punctuation.
+// String literals, quoted identifiers, line/block comments and dollar-quoted
+// bodies are skipped, so keywords inside them never count.
+func sqlTokens(text string) []sqlToken {
+	var toks []sqlToken
+	depth := 0
+	for i := 0; i < len(text); {
+		if end, _ := skipNonCode(text, i); end > i {
+			i = end
+			continue
+		}
+		c := text[i]
+		switch {
+		case c == '(':
+			toks = append(toks, sqlToken{text: "(", depth: depth})
+			depth++
+			i++
+		case c == ')':
+			if depth > 0 {
+				depth--
+			}
+			toks = append(toks, sqlToken{text: ")", depth: depth})
+			i++
+		case c == ';':
+			toks = append(toks, sqlToken{text: ";", depth: depth})
+			i++
+		case isIdentStart(c):
+			j := i + 1
+			for j < len(text) && isIdentPart(text[j]) {
+				j++
+			}
+			toks = append(toks, sqlToken{text: strings.ToUpper(text[i:j]), depth: depth})
+			i = j
+		default:
+			i++
+		}
+	}
+	return toks
+}
+
+// skipNonCode returns the index just past a comment, string literal, quoted
+// identifier or dollar-quoted body starting at i (or i if none starts there);
+// comment reports whether the skipped text was a comment
+func skipNonCode(text string, i int) (end int, comment bool) {
+	c := text[i]
+	// E'...' and $tag$ only start a token outside identifiers (foo$bar$, tablE)
+	wordStart := i == 0 || !isIdentPart(text[i-1])
+	switch {
+	case (c == 'E' || c == 'e') && wordStart && i+1 < len(text) && text[i+1] == '\'':
+		return skipEscapeString(text, i+1), false
+	case c == '-' && i+1 < len(text) && text[i+1] == '-':
+		return skipLineComment(text, i), true
+	case c == '/' && i+1 < len(text) && text[i+1] == '*':
+		return skipBlockComment(text, i), true
+	case c == '\'' || c == '"':
+		return skipQuoted(text, i, c), false
+	case c == '$' && wordStart:
+		if end, ok := skipDollarQuoted(text, i); ok {
+			return end, false
+		}
+	}
+	return i, false
+}
+
+// splitSQL splits text into statements on semicolons that are not inside
+// quotes, comments or dollar-quoted bodies. Comments before a statement stay
+// with it (they carry annotations); empty and comment-only fragments are dropped.
+func splitSQL(text string) []string {
+	var stmts []string
+	start := 0
+	for i := 0; i < len(text); {
+		if end, _ := skipNonCode(text, i); end > i {
+			i = end
+			continue
+		}
+		if text[i] == ';' {
+			stmts = appendStatement(stmts, text[start:i])
+			start = i + 1
+		}
+		i++
+	}
+	return appendStatement(stmts, text[start:])
+}
+
+// splitStatements applies -SQLSpliter: ";" uses the SQL-aware splitter,
+// any other delimiter a plain split
+func splitStatements(text, delim string) []string {
+	if delim == ";" {
+		return splitSQL(text)
+	}
+	return splitByDelimiter(text, delim)
+}
+
+// splitByDelimiter is the plain -SQLSpliter split for delimiters other than ";"
+func splitByDelimiter(text, delim string) []string {
+	var stmts []string
+	for _, part := range strings.Split(text, delim) {
+		stmts = appendStatement(stmts, part)
+	}
+	return stmts
+}
+
+func appendStatement(stmts []string, stmt string) []string {
+	stmt = strings.TrimSpace(stmt)
+	if !hasCode(stmt) {
+		return stmts
+	}
+	return append(stmts, stmt)
+}
+
+// hasCode reports whether text contains anything besides whitespace and comments
+func hasCode(text string) bool {
+	for i := 0; i < len(text); {
+		if end, comment := skipNonCode(text, i); end > i {
+			if !comment {
+				return true
+			}
+			i = end
+			continue
+		}
+		switch text[i] {
+		case ' ', '\t', '\n', '\r', '\f':
+			i++
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
+}
+
+func isIdentPart(c byte) bool {
+	return isIdentStart(c) || c >= '0' && c <= '9' || c == '$'
+}
+
+// skipLineComment returns the index just past a "--" comment
+func skipLineComment(text string, i int) int {
+	if j := strings.IndexByte(text[i:], '\n'); j >= 0 {
+		return i + j + 1
+	}
+	return len(text)
+}
+
+// skipBlockComment returns the index just past a (possibly nested) /* */ comment
+func skipBlockComment(text string, i int) int {
+	nest := 0
+	for i < len(text) {
+		switch {
+		case strings.HasPrefix(text[i:], "/*"):
+			nest++
+			i += 2
+		case strings.HasPrefix(text[i:], "*/"):
+			nest--
+			i += 2
+			if nest == 0 {
+				return i
+			}
+		default:
+			i++
+		}
+	}
+	return len(text)
+}
+
+// skipQuoted returns the index just past a '...' or "..." token; doubled quotes are escapes
+func skipQuoted(text string, i int, q byte) int {
+	for i++; i < len(text); i++ {
+		if text[i] != q {
+			continue
+		}
+		if i+1 < len(text) && text[i+1] == q {
+			i++
+			continue
+		}
+		return i + 1
+	}
+	return len(text)
+}
+
+// skipEscapeString returns the index just past an E'...' string whose quote is
+// at i; backslash escapes the next character, doubled quotes work as well
+func skipEscapeString(text string, i int) int {
+	for i++; i < len(text); i++ {
+		switch {
+		case text[i] == '\\':
+			i++
+		case text[i] != '\'':
+		case i+1 < len(text) && text[i+1] == '\'':
+			i++
+		default:
+			return i + 1
+		}
+	}
+	return len(text)
+}
+
+// skipDollarQuoted returns the index just past a $tag$...$tag$ body;
+// ok is false when text[i] does not start a dollar quote (e.g. a $1 parameter)
+func skipDollarQuoted(text string, i int) (int, bool) {
+	j := i + 1
+	for j < len(text) && text[j] != '$' {
+		c := text[j]
+		if !isIdentStart(c) && (j == i+1 || c < '0' || c > '9') {
+			return i, false
+		}
+		j++
+	}
+	if j >= len(text) {
+		return i, false
+	}
+	tag := text[i : j+1]
+	if end := strings.Index(text[j+1:], tag); end >= 0 {
+		return j + 1 + end + len(tag), true
+	}
+	return len(text), true
+}
@@ -0,0 +1,93 @@
+package watcher
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Test keyword scanning skips literals, identifiers, comments and dollar quotes
+func TestSQLTokens(t *testing.T) {
+	text := `select 'delete;' as "update", $$ insert $$, $fn$ drop $fn$ -- merge
+	/* outer /* nested */ truncate */ from t where x = $1;`
+	var words []string
+	for _, tok := range sqlTokens(text) {
+		words = append(words, tok.text)
+	}
+	got := strings.Join(words, " ")
+	if got != "SELECT AS FROM T WHERE X ;" {
+		t.Errorf("sqlTokens() = %q", got)
+	}
+}
+
+// Test statement splitting on top-level semicolons
+func TestSplitSQL(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected []string
+	}{
+		{
+			"simple with trailing semicolon",
+			"show stats;show pools;",
+			[]string{"show stats", "show pools"},
+		},
+		{
+			"semicolon in string and identifier",
+			`select 'a;b' as x; select 1 as "c;d"`,
+			[]string{`select 'a;b' as x`, `select 1 as "c;d"`},
+		},
+		{
+			"escaped quote",
+			`select 'it''s; fine'; select 2`,
+			[]string{`select 'it''s; fine'`, "select 2"},
+		},
+		{
+			"comments",
+			"-- first; query\nselect 1; /* a; b */ select 2;\n-- trailing comment only\n",
+			[]string{"-- first; query\nselect 1", "/* a; b */ select 2"},
+		},
+		{
+			"dollar quotes",
+			"select $$a;b$$; select $tag$ x; $$ y $tag$;",
+			[]string{"select $$a;b$$", "select $tag$ x; $$ y $tag$"},
+		},
+		{
+			"backslash escapes in E strings",
+			`select E'it\'s; x', e'a\\'; select 'b\'; select 3`,
+			[]string{`select E'it\'s; x', e'a\\'`, `select 'b\'`, "select 3"},
+		},
+		{
+			"dollar sign inside an identifier",
+			"select foo$bar$ from t; select 2; select $$ y $$",
+			[]string{"select foo$bar$ from t", "select 2", "select $$ y $$"},
+		},
+		{
+			"positional parameter is not a dollar quote",
+			"select $1; select 2",
+			[]string{"select $1", "select 2"},
+		},
+		{
+			"empty fragments",
+			";;  ;\n",
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := splitSQL(tt.input)
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("splitSQL() = %q, want %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+// Test custom delimiters keep the plain split but drop empty fragments
+func TestSplitStatementsCustomDelimiter(t *testing.T) {
+	got := splitStatements("select 1|select 2|\n", "|")
+	want := []string{"select 1", "select 2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("splitStatements() = %q, want %q", got, want)
+	}
+}
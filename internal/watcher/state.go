@@ -0,0 +1,192 @@
+package watcher
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// persistedSample is the state file form of a sample
+type persistedSample struct {
+	Name   string      `json:"name"`
+	Family string      `json:"family,omitempty"`
+	Prefix string      `json:"prefix,omitempty"`
+	Column string      `json:"column,omitempty"`
+	DB     string      `json:"db"`
+	Labels [][2]string `json:"labels,omitempty"`
+	Value  float64     `json:"value"`
+	Kind   metricKind  `json:"kind,omitempty"`
+	Unit   string      `json:"unit,omitempty"`
+	Help   string      `json:"help,omitempty"`
+	TS     time.Time   `json:"ts,omitzero"`
+}
+
+// cacheEntry is the last result of a query with a minimum refresh interval
+type cacheEntry struct {
+	At       time.Time         `json:"at"`
+	Interval time.Duration     `json:"interval"`
+	Samples  []persistedSample `json:"samples"`
+}
+
+// runState is what survives between collections: in memory with -interval,
+// and in -state-file across separate invocations
+type runState struct {
+	Cache    map[string]*cacheEntry `json:"cache,omitempty"`
+	Previous map[string]*prevValue  `json:"previous,omitempty"`
+	// Targets are the discovered servers of the last run, see refreshTargets
+	Targets []string `json:"targets,omitempty"`
+}
+
+// stateStore guards runState; processDB goroutines use it concurrently
+type stateStore struct {
+	mu     sync.Mutex
+	loaded bool
+	data   runState
+}
+
+var persist = &stateStore{}
+
+// loadState reads -state-file once per process; a missing file is not an error
+func loadState() error {
+	persist.mu.Lock()
+	defer persist.mu.Unlock()
+	if persist.loaded || flagParam.stateFile == "" {
+		return nil
+	}
+	persist.loaded = true
+	content, err := os.ReadFile(flagParam.stateFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var data runState
+	if err := json.Unmarshal(content, &data); err != nil {
+		return fmt.Errorf("ignoring corrupt %s: %w", flagParam.stateFile, err)
+	}
+	persist.data = data
+	return nil
+}
+
+// saveState prunes outdated entries and atomically rewrites -state-file
+func saveState() error {
+	persist.mu.Lock()
+	defer persist.mu.Unlock()
+	now := time.Now()
+	for k, e := range persist.data.Cache {
+		if now.Sub(e.At) > 2*e.Interval {
+			delete(persist.data.Cache, k)
+		}
+	}
+	persist.prunePrevious(now)
+	if flagParam.stateFile == "" {
+		return nil
+	}
+	content, err := json.Marshal(&persist.data)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(flagParam.stateFile), filepath.Base(flagParam.stateFile)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), flagParam.stateFile)
+}
+
+func cacheKey(dbname string, q queryDef) string {
+	return stateDB(dbname) + "|" + q.id()
+}
+
+// cachedResult returns the cached samples of a query that is not due for refresh yet
+func (st *stateStore) cachedResult(dbname string, q queryDef) ([]sample, bool) {
+	if q.minInterval <= 0 {
+		return nil, false
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	e, ok := st.data.Cache[cacheKey(dbname, q)]
+	if !ok {
+		return nil, false
+	}
+	age := time.Since(e.At)
+	if age < 0 || age >= q.minInterval {
+		return nil, false
+	}
+	samples := make([]sample, 0, len(e.Samples)+1)
+	for i := range e.Samples {
+		samples = append(samples, e.Samples[i].sample())
+	}
+	return appendCacheAge(samples, dbname, q, age), true
+}
+
+// storeResult caches a fresh result if the query has a minimum interval and
+// returns the samples to write
+func (st *stateStore) storeResult(dbname string, q queryDef, samples []sample) []sample {
+	if q.minInterval <= 0 {
+		return samples
+	}
+	e := &cacheEntry{At: time.Now(), Interval: q.minInterval, Samples: make([]persistedSample, 0, len(samples))}
+	for i := range samples {
+		e.Samples = append(e.Samples, newPersistedSample(&samples[i]))
+	}
+	st.mu.Lock()
+	if st.data.Cache == nil {
+		st.data.Cache = make(map[string]*cacheEntry)
+	}
+	st.data.Cache[cacheKey(dbname, q)] = e
+	st.mu.Unlock()
+	return appendCacheAge(samples, dbname, q, 0)
+}
+
+// appendCacheAge adds the <prefix>_cache_age_seconds self-metric if requested
+func appendCacheAge(samples []sample, dbname string, q queryDef, age time.Duration) []sample {
+	if !flagParam.cacheAgeMetric {
+		return samples
+	}
+	return append(samples, sample{
+		name:   normalizeName(prefixedName("cache_age_seconds")),
+		prefix: flagParam.prefixMetric,
+		column: "cache_age_seconds",
+		db:     dbname,
+		labels: []label{{name: "query", value: q.displayName()}},
+		value:  age.Seconds(),
+		unit:   "seconds",
+		help:   "Age of the cached query result",
+	})
+}
+
+func newPersistedSample(s *sample) persistedSample {
+	p := persistedSample{
+		Name: s.name, Family: s.family, Prefix: s.prefix, Column: s.column, DB: s.db,
+		Value: s.value, Kind: s.kind, Unit: s.unit, Help: s.help, TS: s.ts,
+	}
+	for _, l := range s.labels {
+		p.Labels = append(p.Labels, [2]string{l.name, l.value})
+	}
+	return p
+}
+
+func (p *persistedSample) sample() sample {
+	s := sample{
+		name: p.Name, family: p.Family, prefix: p.Prefix, column: p.Column, db: p.DB,
+		value: p.Value, kind: p.Kind, unit: p.Unit, help: p.Help, ts: p.TS,
+	}
+	for _, l := range p.Labels {
+		s.labels = append(s.labels, label{name: l[0], value: l[1]})
+	}
+	return s
+}
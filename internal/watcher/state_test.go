@@ -0,0 +1,127 @@
+package watcher
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test serving cached results until the minimum interval passes
+func TestResultCache(t *testing.T) {
+	flagParam = FlagParam{prefixMetric: "pgwatch", cacheAgeMetric: true}
+	persist = &stateStore{}
+	q := queryDef{sql: "select pg_total_relation_size(1)", name: "bloat", minInterval: time.Hour}
+
+	if _, ok := persist.cachedResult("db", q); ok {
+		t.Fatal("cachedResult() hit on empty cache")
+	}
+	fresh := []sample{{name: "pgwatch_bloat_size", db: "db", value: 42, labels: []label{{"relname", "t"}}}}
+	written := persist.storeResult("db", q, fresh)
+	if len(written) != 2 || written[1].name != "pgwatch_cache_age_seconds" || written[1].value != 0 {
+		t.Fatalf("storeResult() = %+v", written)
+	}
+
+	cached, ok := persist.cachedResult("db", q)
+	if !ok || len(cached) != 2 || cached[0].value != 42 || cached[0].labels[0].value != "t" {
+		t.Fatalf("cachedResult() = %+v, %v", cached, ok)
+	}
+	if cached[1].labels[0].value != "bloat" {
+		t.Errorf("cache age label = %v", cached[1].labels)
+	}
+
+	// other databases and changed SQL do not share entries
+	if _, ok := persist.cachedResult("other", q); ok {
+		t.Error("cache hit for another database")
+	}
+	if _, ok := persist.cachedResult("db", queryDef{sql: "select 2", minInterval: time.Hour}); ok {
+		t.Error("cache hit for different SQL")
+	}
+
+	// expired entries are refreshed
+	persist.data.Cache[cacheKey("db", q)].At = time.Now().Add(-2 * time.Hour)
+	if _, ok := persist.cachedResult("db", q); ok {
+		t.Error("cache hit for expired entry")
+	}
+
+	// queries without an interval are never cached
+	plain := queryDef{sql: "select 1"}
+	if got := persist.storeResult("db", plain, fresh); len(got) != 1 {
+		t.Errorf("storeResult() without interval = %+v", got)
+	}
+}
+
+// Test that the cache survives separate invocations through -state-file
+func TestStateFileRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	flagParam = FlagParam{stateFile: path}
+	persist = &stateStore{}
+	q := queryDef{sql: "select 1", minInterval: time.Hour}
+	ts := time.Unix(1700000000, 0).UTC()
+	persist.storeResult("db", q, []sample{{name: "m", db: "db", value: 1, kind: kindCounter, ts: ts}})
+	if err := saveState(); err != nil {
+		t.Fatalf("saveState() error = %v", err)
+	}
+
+	persist = &stateStore{}
+	if err := loadState(); err != nil {
+		t.Fatalf("loadState() error = %v", err)
+	}
+	cached, ok := persist.cachedResult("db", q)
+	if !ok || cached[0].kind != kindCounter || !cached[0].ts.Equal(ts) {
+		t.Errorf("cachedResult() after reload = %+v, %v", cached, ok)
+	}
+
+	// a missing file is fine
+	flagParam.stateFile = filepath.Join(t.TempDir(), "none.json")
+	persist = &stateStore{}
+	if err := loadState(); err != nil {
+		t.Errorf("loadState() on missing file error = %v", err)
+	}
+}
+
+// Test that a cached histogram keeps its family through -state-file and
+// renders as one OpenMetrics family
+func TestCachedHistogramRoundTrip(t *testing.T) {
+	flagParam = FlagParam{prefixMetric: "pgwatch", stateFile: filepath.Join(t.TempDir(), "state.json")}
+	persist = &stateStore{}
+	q := histogramQuery(t, "-- name: lat\n-- histogram: le, n\n-- min_interval: 1h\nselect 1")
+	fresh := synthesizeDistribution(q, q.prefix(), "db", []distRow{
+		{vals: map[string]any{"le": 1.0, "n": 2.0}},
+		{vals: map[string]any{"le": 5.0, "n": 1.0}},
+	})
+	persist.storeResult("db", q, fresh)
+	if err := saveState(); err != nil {
+		t.Fatalf("saveState() error = %v", err)
+	}
+	persist = &stateStore{}
+	if err := loadState(); err != nil {
+		t.Fatalf("loadState() error = %v", err)
+	}
+	cached, ok := persist.cachedResult("db", q)
+	if !ok || len(cached) != len(fresh) {
+		t.Fatalf("cachedResult() = %+v, %v", cached, ok)
+	}
+
+	var buf bytes.Buffer
+	om := &omSink{w: &buf}
+	if err := om.write(cached); err != nil {
+		t.Fatal(err)
+	}
+	if err := om.close(); err != nil {
+		t.Fatal(err)
+	}
+	got := buf.String()
+	if strings.Count(got, "# TYPE ") != 1 || !strings.Contains(got, "# TYPE pgwatch_lat histogram\n") {
+		t.Errorf("openmetrics output of cached histogram =\n%s", got)
+	}
+	for _, line := range []string{
+		`pgwatch_lat_bucket{le="+Inf",db="db"} 3`,
+		`pgwatch_lat_count{db="db"} 3`,
+	} {
+		if !strings.Contains(got, line) {
+			t.Errorf("openmetrics output misses %q:\n%s", line, got)
+		}
+	}
+}
@@ -0,0 +1,415 @@
+package watcher
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"gopkg.in/yaml.v3"
+)
+
+// target is one server to collect from: an entry of -targets-file, a DNS SRV
+// record or one host of a multi-host connection string
+type target struct {
+	name    string // instance label: host:port unless the file sets instance
+	connstr string
+	labels  []label // file labels plus instance, sorted by name
+}
+
+// targetGroup is one entry of -targets-file, laid out like Prometheus file_sd_configs
+type targetGroup struct {
+	Targets []string          `yaml:"targets"`
+	Labels  map[string]string `yaml:"labels"`
+}
+
+// lookupSRV resolves DNS SRV records; tests may replace it
+var lookupSRV = net.DefaultResolver.LookupSRV
+
+var (
+	// targets is the list collected by the current run
+	targets []target
+	// targetsKnown is set once targets were discovered, so the first run logs no changes
+	targetsKnown bool
+	// fileTargets is the last valid content of -targets-file, read at version targetsStamp
+	fileTargets  []target
+	targetsStamp fileStamp
+	// srvTargets keeps the last successful resolution of every -dns-srv name
+	srvTargets = make(map[string][]target)
+	// current is the target being collected; zero with a single -conn server
+	current target
+)
+
+// discoveryMode reports whether servers come from target discovery rather than a single -conn
+func discoveryMode() bool {
+	return flagParam.targetsFile != "" || len(flagParam.dnsSRV) > 0 || flagParam.multiHost
+}
+
+// connString is the connection string of the server being collected
+func connString() string {
+	if current.connstr != "" {
+		return current.connstr
+	}
+	return connParam.connstr
+}
+
+// stateDB qualifies a database with the current target in cache and delta state keys
+func stateDB(dbname string) string {
+	if current.name == "" {
+		return dbname
+	}
+	return current.name + "/" + dbname
+}
+
+// loadTargets reads a JSON or YAML targets file; -conn is the base every target extends
+func loadTargets(path string) ([]target, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	list, err := parseTargets(content, connParam.connstr)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return list, nil
+}
+
+func parseTargets(content []byte, base string) ([]target, error) {
+	var groups []targetGroup
+	if err := yaml.Unmarshal(content, &groups); err != nil {
+		return nil, err
+	}
+	var list []target
+	seen := make(map[string]bool)
+	for i, g := range groups {
+		for _, addr := range g.Targets {
+			connstr, err := targetConnString(base, addr)
+			if err != nil {
+				return nil, fmt.Errorf("group %d: %w", i+1, err)
+			}
+			hosts, err := newTargets(connstr, g.Labels)
+			if err != nil {
+				return nil, fmt.Errorf("group %d: target %q: %w", i+1, addr, err)
+			}
+			for _, t := range hosts {
+				if seen[t.name] {
+					return nil, fmt.Errorf("group %d: duplicate target %s (set distinct instance labels)", i+1, t.name)
+				}
+				seen[t.name] = true
+				list = append(list, t)
+			}
+		}
+	}
+	return list, nil
+}
+
+// targetConnString turns a target entry into a connection string: host[:port]
+// and key=value entries extend -conn, postgres:// URLs stand alone
+func targetConnString(base, addr string) (string, error) {
+	addr = strings.TrimSpace(addr)
+	if addr == "" {
+		return "", fmt.Errorf("empty target")
+	}
+	if isConnURL(addr) {
+		return addr, nil
+	}
+	if isConnURL(base) {
+		return "", fmt.Errorf("target %q: -conn must use the key=value form to be extended by targets", addr)
+	}
+	if strings.Contains(addr, "=") {
+		return base + " " + addr, nil
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return base + " host=" + addr, nil // no port: keep the one of -conn
+	}
+	return base + " host=" + host + " port=" + port, nil
+}
+
+func isConnURL(s string) bool {
+	return strings.HasPrefix(s, "postgres://") || strings.HasPrefix(s, "postgresql://")
+}
+
+// connHosts returns host and port of every host of a connection string, in
+// order; libpq multi-host strings (host=a,b,c) have several
+func connHosts(connstr string) ([][2]string, error) {
+	cfg, err := pgx.ParseConfig(connstr)
+	if err != nil {
+		return nil, err
+	}
+	hosts := [][2]string{{cfg.Host, strconv.Itoa(int(cfg.Port))}}
+	// pgx adds a fallback per host and TLS mode; only the hosts matter here
+	for _, fb := range cfg.Fallbacks {
+		if h := [2]string{fb.Host, strconv.Itoa(int(fb.Port))}; !slices.Contains(hosts, h) {
+			hosts = append(hosts, h)
+		}
+	}
+	return hosts, nil
+}
+
+// newTargets builds the targets of a connection string: one per host, so every
+// host of a multi-host string is collected on its own rather than the first
+// reachable one. Targets carry the given labels plus instance.
+func newTargets(connstr string, labels map[string]string) ([]target, error) {
+	hosts, err := connHosts(connstr)
+	if err != nil {
+		return nil, err
+	}
+	if len(hosts) > 1 && isConnURL(connstr) {
+		return nil, fmt.Errorf("multi-host postgres:// URLs are not supported, use host=a,b,c")
+	}
+	base := connstr
+	if len(hosts) > 1 {
+		// host selection settings would make a single-host target refuse its server
+		base = withoutConnSettings(connstr, "target_session_attrs", "load_balance_hosts")
+	}
+	var list []target
+	for _, h := range hosts {
+		t := target{connstr: connstr}
+		if len(hosts) > 1 {
+			t.connstr = base + " host=" + h[0] + " port=" + h[1]
+		}
+		for k, v := range labels {
+			if strings.HasPrefix(k, "__") {
+				continue // meta labels, as in Prometheus
+			}
+			name := normalizeName(k)
+			if name == "instance" {
+				t.name = v
+			}
+			t.labels = append(t.labels, label{name: name, value: v})
+		}
+		if t.name == "" {
+			t.name = net.JoinHostPort(h[0], h[1])
+			t.labels = append(t.labels, label{name: "instance", value: t.name})
+		}
+		slices.SortFunc(t.labels, func(a, b label) int { return strings.Compare(a.name, b.name) })
+		list = append(list, t)
+	}
+	return list, nil
+}
+
+// withoutConnSettings removes settings from a key=value connection string;
+// values may be single-quoted with backslash escapes as in libpq
+func withoutConnSettings(connstr string, keys ...string) string {
+	var kept []string
+	for i := 0; i < len(connstr); {
+		for i < len(connstr) && isConnSpace(connstr[i]) {
+			i++
+		}
+		start := i
+		for i < len(connstr) && connstr[i] != '=' && !isConnSpace(connstr[i]) {
+			i++
+		}
+		key := connstr[start:i]
+		for i < len(connstr) && isConnSpace(connstr[i]) {
+			i++
+		}
+		if i < len(connstr) && connstr[i] == '=' {
+			i++
+			for i < len(connstr) && isConnSpace(connstr[i]) {
+				i++
+			}
+			quoted := i < len(connstr) && connstr[i] == '\''
+			if quoted {
+				i++
+			}
+			for i < len(connstr) {
+				c := connstr[i]
+				if c == '\\' {
+					i += 2
+					continue
+				}
+				if quoted && c == '\'' || !quoted && isConnSpace(c) {
+					break
+				}
+				i++
+			}
+			if quoted && i < len(connstr) {
+				i++ // closing quote
+			}
+		}
+		i = min(i, len(connstr))
+		if start < i && !slices.Contains(keys, key) {
+			kept = append(kept, connstr[start:i])
+		}
+	}
+	return strings.Join(kept, " ")
+}
+
+func isConnSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+// resolveSRV returns one target per SRV record of name (e.g. _postgresql._tcp.db.example.com),
+// sorted by instance; every target extends -conn with the record's host and port
+func resolveSRV(ctxParent context.Context, name string) ([]target, error) {
+	ctx, cancel := context.WithTimeout(ctxParent, flagParam.pgTimeout)
+	defer cancel()
+	_, records, err := lookupSRV(ctx, "", "", name)
+	if err != nil {
+		return nil, err
+	}
+	var list []target
+	for _, r := range records {
+		addr := net.JoinHostPort(strings.TrimSuffix(r.Target, "."), strconv.Itoa(int(r.Port)))
+		connstr, err := targetConnString(connParam.connstr, addr)
+		if err != nil {
+			return nil, err
+		}
+		ts, err := newTargets(connstr, nil)
+		if err != nil {
+			return nil, fmt.Errorf("target %q: %w", addr, err)
+		}
+		list = append(list, ts...)
+	}
+	slices.SortFunc(list, func(a, b target) int { return strings.Compare(a.name, b.name) })
+	return list, nil
+}
+
+// readTargets loads -targets-file; on error the previous file targets stay in place
+func readTargets() error {
+	targetsStamp = statFile(flagParam.targetsFile)
+	list, err := loadTargets(flagParam.targetsFile)
+	if err != nil {
+		return err
+	}
+	fileTargets = list
+	return nil
+}
+
+// discoverTargets returns the targets of -targets-file (re-read if it changed),
+// of every -dns-srv name (resolved again) and of a multi-host -conn. Failing
+// sources keep their previous targets and make the result incomplete; an
+// instance found twice is collected once.
+func discoverTargets(ctx context.Context) (res []target, complete bool) {
+	var list []target
+	complete = true
+	if flagParam.targetsFile != "" {
+		if statFile(flagParam.targetsFile) != targetsStamp {
+			if err := readTargets(); err != nil {
+				log.Printf("targets file: %v; keeping %d previous targets", err, len(fileTargets))
+				complete = false
+			}
+		}
+		list = append(list, fileTargets...)
+	}
+	for _, name := range flagParam.dnsSRV {
+		ts, err := resolveSRV(ctx, name)
+		if err != nil {
+			log.Printf("WARN: SRV %s: %v; keeping %d previous targets", name, err, len(srvTargets[name]))
+			ts = srvTargets[name]
+			complete = false
+		}
+		srvTargets[name] = ts
+		list = append(list, ts...)
+	}
+	if flagParam.targetsFile == "" && len(flagParam.dnsSRV) == 0 {
+		hosts, err := newTargets(connParam.connstr, nil)
+		if err != nil {
+			log.Printf("-conn: %v", err)
+			complete = false
+		}
+		list = hosts
+	}
+
+	seen := make(map[string]bool, len(list))
+	res = list[:0:0]
+	for _, t := range list {
+		if !seen[t.name] {
+			seen[t.name] = true
+			res = append(res, t)
+		}
+	}
+	return res, complete
+}
+
+// refreshTargets discovers the targets of this run, logs added and removed
+// targets and forgets the state of removed ones. A new process compares against
+// the targets recorded in -state-file, so one-shot runs forget removed targets too.
+func refreshTargets(ctx context.Context) {
+	prev, known := targets, targetsKnown
+	list, complete := discoverTargets(ctx)
+	targets, targetsKnown = list, true
+	stored := persist.recordTargets(targets, complete)
+	if !known {
+		if !complete {
+			return // a failing source is no reason to forget its targets
+		}
+		for _, name := range stored {
+			if !slices.ContainsFunc(targets, func(n target) bool { return n.name == name }) {
+				log.Printf("target removed: %s", name)
+				persist.forgetTarget(name)
+			}
+		}
+		return
+	}
+	for _, t := range prev {
+		if !slices.ContainsFunc(targets, func(n target) bool { return n.name == t.name }) {
+			log.Printf("target removed: %s", t.name)
+			persist.forgetTarget(t.name)
+		}
+	}
+	for _, t := range targets {
+		if !slices.ContainsFunc(prev, func(p target) bool { return p.name == t.name }) {
+			log.Printf("target added: %s", t.name)
+		}
+	}
+}
+
+// recordTargets stores the names of the discovered targets in the state and
+// returns the previous ones. An incomplete discovery keeps the previous names,
+// so their state is pruned once the failing source answers again.
+func (st *stateStore) recordTargets(list []target, complete bool) []string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	prev := st.data.Targets
+	var names []string
+	if !complete {
+		names = append(names, prev...)
+	}
+	for _, t := range list {
+		if !slices.Contains(names, t.name) {
+			names = append(names, t.name)
+		}
+	}
+	slices.Sort(names)
+	st.data.Targets = names
+	return prev
+}
+
+// forgetTarget drops the cached results and delta state of a removed target
+func (st *stateStore) forgetTarget(name string) {
+	prefix := name + "/"
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for k := range st.data.Cache {
+		if strings.HasPrefix(k, prefix) {
+			delete(st.data.Cache, k)
+		}
+	}
+	for k := range st.data.Previous {
+		if strings.HasPrefix(k, prefix) {
+			delete(st.data.Previous, k)
+		}
+	}
+}
+
+// withTargetLabels appends the labels of the current target to every sample
+func withTargetLabels(samples []sample) []sample {
+	if current.name == "" {
+		return samples
+	}
+	res := make([]sample, len(samples))
+	for i, s := range samples {
+		s.labels = append(append([]label(nil), s.labels...), current.labels...)
+		s.target = current.name
+		res[i] = s
+	}
+	return res
+}
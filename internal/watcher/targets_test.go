@@ -0,0 +1,222 @@
+package watcher
+
+import (
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTargets(t *testing.T) {
+	base := "user=postgres host=127.0.0.1 port=5435"
+	content := `
+- targets: ["10.0.0.1:5432", "db2.example.com"]
+  labels: {env: prod, cluster-name: main, __meta_x: y}
+- targets: ["host=10.0.0.3 port=6432 sslmode=require"]
+  labels: {instance: replica3}
+`
+	list, err := parseTargets([]byte(content), base)
+	if err != nil {
+		t.Fatalf("parseTargets() error = %v", err)
+	}
+	if len(list) != 3 {
+		t.Fatalf("parseTargets() = %+v", list)
+	}
+	if list[0].name != "10.0.0.1:5432" || list[0].connstr != base+" host=10.0.0.1 port=5432" {
+		t.Errorf("target 1 = %+v", list[0])
+	}
+	want := []label{{"cluster_name", "main"}, {"env", "prod"}, {"instance", "10.0.0.1:5432"}}
+	if len(list[0].labels) != 3 || list[0].labels[0] != want[0] || list[0].labels[1] != want[1] || list[0].labels[2] != want[2] {
+		t.Errorf("target 1 labels = %v, want %v", list[0].labels, want)
+	}
+	if list[1].name != "db2.example.com:5435" {
+		t.Errorf("target 2 keeps the -conn port: %+v", list[1])
+	}
+	if list[2].name != "replica3" || len(list[2].labels) != 1 {
+		t.Errorf("target 3 = %+v", list[2])
+	}
+
+	// JSON is read as well
+	list, err = parseTargets([]byte(`[{"targets": ["postgres://u@10.0.0.9:5433/postgres"]}]`), base)
+	if err != nil || len(list) != 1 || list[0].name != "10.0.0.9:5433" {
+		t.Errorf("parseTargets(json) = %+v, %v", list, err)
+	}
+
+	for _, bad := range []string{
+		`- targets: ["a:5432", "a:5432"]`,
+		`- targets: [""]`,
+		`- targets: ["port=abc"]`,
+		`targets: x`,
+	} {
+		if _, err := parseTargets([]byte(bad), base); err == nil {
+			t.Errorf("parseTargets(%q) expected error", bad)
+		}
+	}
+}
+
+// Test re-reading the targets file: added and removed targets, broken files
+func TestRefreshTargets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "targets.yml")
+	writeFile(t, path, `[{targets: ["a:5432", "b:5432"]}]`)
+	flagParam = FlagParam{targetsFile: path}
+	connParam = ConnectionString{connstr: "user=postgres"}
+	persist = &stateStore{}
+	targets, targetsKnown, targetsStamp = nil, false, fileStamp{}
+	refreshTargets(context.Background())
+	if len(targets) != 2 {
+		t.Fatalf("refreshTargets() = %v", targets)
+	}
+
+	// state of b is forgotten once b leaves the file
+	current = targets[1]
+	persist.storeResult("app", queryDef{sql: "select 1", minInterval: time.Hour}, nil)
+	current = target{}
+	persist.storeResult("app", queryDef{sql: "select 1", minInterval: time.Hour}, nil)
+
+	writeFile(t, path, `[{targets: ["a:5432", "c:5432", "d:5432"]}]`)
+	refreshTargets(context.Background())
+	var names []string
+	for _, tg := range targets {
+		names = append(names, tg.name)
+	}
+	if got := strings.Join(names, ","); got != "a:5432,c:5432,d:5432" {
+		t.Errorf("targets after refresh = %s", got)
+	}
+	if len(persist.data.Cache) != 1 {
+		t.Errorf("cache after removing b = %v", persist.data.Cache)
+	}
+
+	writeFile(t, path, `[{targets: [`)
+	refreshTargets(context.Background())
+	if len(targets) != 3 {
+		t.Errorf("broken file replaced targets: %+v", targets)
+	}
+}
+
+// Test that a new process forgets targets removed since the state file was written
+func TestRefreshTargetsFromState(t *testing.T) {
+	defer func() { current = target{} }()
+	path := filepath.Join(t.TempDir(), "targets.yml")
+	writeFile(t, path, `[{targets: ["a:5432", "b:5432"]}]`)
+	flagParam = FlagParam{targetsFile: path}
+	connParam = ConnectionString{connstr: "user=postgres"}
+	persist = &stateStore{}
+	targets, targetsKnown, targetsStamp, fileTargets = nil, false, fileStamp{}, nil
+	refreshTargets(context.Background())
+	current = targets[1]
+	persist.storeResult("app", queryDef{sql: "select 1", minInterval: time.Hour}, nil)
+	if got := strings.Join(persist.data.Targets, ","); got != "a:5432,b:5432" {
+		t.Fatalf("stored targets = %s", got)
+	}
+
+	// next invocation: only the state file remembers b
+	writeFile(t, path, `[{targets: ["a:5432"]}]`)
+	targets, targetsKnown, targetsStamp, fileTargets = nil, false, fileStamp{}, nil
+	refreshTargets(context.Background())
+	if len(persist.data.Cache) != 0 || strings.Join(persist.data.Targets, ",") != "a:5432" {
+		t.Errorf("state after removing b: cache %v, targets %v", persist.data.Cache, persist.data.Targets)
+	}
+
+	// a broken file forgets nothing and keeps the stored names
+	writeFile(t, path, `[{targets: [`)
+	targets, targetsKnown, targetsStamp, fileTargets = nil, false, fileStamp{}, nil
+	refreshTargets(context.Background())
+	if strings.Join(persist.data.Targets, ",") != "a:5432" {
+		t.Errorf("targets after broken file = %v", persist.data.Targets)
+	}
+}
+
+func TestWithTargetLabels(t *testing.T) {
+	defer func() { current = target{} }()
+	row := []label{{"datname", "app"}}
+	samples := []sample{{name: "a", db: "app", labels: row}}
+	if got := withTargetLabels(samples); len(got[0].labels) != 1 || stateDB("app") != "app" {
+		t.Errorf("withTargetLabels() without target = %+v", got)
+	}
+
+	current = target{name: "pg1", labels: []label{{"instance", "pg1"}}}
+	got := withTargetLabels(samples)
+	if len(got[0].labels) != 2 || got[0].target != "pg1" || len(row) != 1 {
+		t.Errorf("withTargetLabels() = %+v", got)
+	}
+	if stateDB("app") != "pg1/app" {
+		t.Errorf("stateDB() = %s", stateDB("app"))
+	}
+}
+
+// Test one target per host of a multi-host connection string
+func TestMultiHostTargets(t *testing.T) {
+	list, err := newTargets("user=postgres host=pg1,pg2,pg3 port=5432,5433,5432", map[string]string{"cluster": "main"})
+	if err != nil || len(list) != 3 {
+		t.Fatalf("newTargets() = %+v, %v", list, err)
+	}
+	if list[1].name != "pg2:5433" || !strings.HasSuffix(list[1].connstr, " host=pg2 port=5433") {
+		t.Errorf("second host = %+v", list[1])
+	}
+	if hosts, err := connHosts(list[1].connstr); err != nil || len(hosts) != 1 {
+		t.Errorf("per-host connstr still has %v hosts, %v", hosts, err)
+	}
+	if list[2].labels[0] != (label{"cluster", "main"}) || list[2].labels[1] != (label{"instance", "pg3:5432"}) {
+		t.Errorf("labels = %v", list[2].labels)
+	}
+
+	// host selection settings of the multi-host string are dropped per host
+	list, err = newTargets("user=postgres host=pg1,pg2 target_session_attrs=read-write application_name='a b' load_balance_hosts = random", nil)
+	if err != nil || len(list) != 2 || list[0].connstr != "user=postgres host=pg1,pg2 application_name='a b' host=pg1 port=5432" {
+		t.Errorf("newTargets(target_session_attrs) = %+v, %v", list, err)
+	}
+	if got := withoutConnSettings(`password='x\' y' target_session_attrs=any  sslmode=disable`, "target_session_attrs"); got != `password='x\' y' sslmode=disable` {
+		t.Errorf("withoutConnSettings() = %q", got)
+	}
+
+	// a single host keeps its connection string untouched
+	if list, _ := newTargets("host=pg1 port=5432", nil); len(list) != 1 || list[0].connstr != "host=pg1 port=5432" {
+		t.Errorf("single host = %+v", list)
+	}
+	if _, err := newTargets("postgres://u@pg1:5432,pg2:5432/postgres", nil); err == nil {
+		t.Error("multi-host URL expected error")
+	}
+	// a file entry with several hosts expands as well
+	if list, err := parseTargets([]byte(`[{targets: ["host=a,b"]}]`), "user=postgres port=5432"); err != nil || len(list) != 2 {
+		t.Errorf("parseTargets(multi-host) = %+v, %v", list, err)
+	}
+}
+
+// Test SRV discovery, re-resolution and keeping the last result on DNS errors
+func TestSRVTargets(t *testing.T) {
+	defer func(f func(context.Context, string, string, string) (string, []*net.SRV, error)) { lookupSRV = f }(lookupSRV)
+	records := []*net.SRV{{Target: "pg2.example.com.", Port: 5432}, {Target: "pg1.example.com.", Port: 5433}}
+	var lookupErr error
+	lookupSRV = func(_ context.Context, _, _, name string) (string, []*net.SRV, error) {
+		if name != "_postgresql._tcp.example.com" {
+			t.Errorf("lookupSRV(%q)", name)
+		}
+		return "", records, lookupErr
+	}
+	flagParam = FlagParam{dnsSRV: []string{"_postgresql._tcp.example.com"}, pgTimeout: time.Second}
+	connParam = ConnectionString{connstr: "user=postgres sslmode=disable"}
+	persist = &stateStore{}
+	targets, targetsKnown = nil, false
+	srvTargets = make(map[string][]target)
+
+	refreshTargets(context.Background())
+	if len(targets) != 2 || targets[0].name != "pg1.example.com:5433" ||
+		targets[0].connstr != "user=postgres sslmode=disable host=pg1.example.com port=5433" {
+		t.Fatalf("targets = %+v", targets)
+	}
+
+	records = records[:1]
+	refreshTargets(context.Background())
+	if len(targets) != 1 || targets[0].name != "pg2.example.com:5432" {
+		t.Errorf("targets after re-resolution = %+v", targets)
+	}
+
+	lookupErr = errors.New("no such host")
+	refreshTargets(context.Background())
+	if len(targets) != 1 {
+		t.Errorf("DNS error dropped targets: %+v", targets)
+	}
+}
@@ -7,18 +7,26 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"maps"
 	"math"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"golang.org/x/sync/semaphore"
 )
 
 type FlagParam struct {
-	sqlQuery        []string
+	queries         []queryDef
+	sqlCmd          string
+	sqlFile         string
+	sqlDir          string
+	queriesYAML     string
 	labelColumnsArr []string
 	ignoredColumns  map[string]bool
 	SQLSpliter      string
@@ -28,15 +36,60 @@ type FlagParam struct {
 	prefixMetric    string
 	jobs            int
 	pgTimeout       time.Duration
+	queryTimeout    time.Duration
+	lockTimeout     time.Duration
+	deadline        time.Duration
+	interval        time.Duration
+	stateFile       string
+	cacheAgeMetric  bool
+	readOnly        bool
+	sqlCheck        bool
+	counterColumns  map[string]bool
+	deltaColumns    map[string]bool
+	rateColumns     map[string]bool
+	resetColumn     string
+	maxSeries       int
+	maxQuerySeries  int
+	maxLabelLength  int
+	labelOverflow   string
+	relabel         []relabelRule
+	relabelConfig   string // -relabel-config path, re-read with the query sources
+	pivot           *pivotSpec
+	json            *jsonSpec
+	arrays          map[string]arrayMode
+	pooler          string
+	patroniURL      string
+	patroniLabels   bool
+	passwordFile    string
+	targetsFile     string
+	dnsSRV          []string
+	multiHost       bool
+	outputFormat    string
+	otlpEndpoint    string
+	otlpProtocol    string
+	otlpHeaders     map[string]string
+	otlpTimeout     time.Duration
+	outputAddr      string
+	timestamps      bool
+	timestampColumn string
+	columnUnits     map[string]string
+	build           string
 }
 
 type ConnectionString struct {
 	connstr string
+	// password from -password-file; replaces the password of every connection
+	password string
 }
 
 var (
 	flagParam FlagParam
 	connParam ConnectionString
+	// nodeRole is rolePrimary or roleReplica once checkDbRoleOnce ran (or a finer
+	// replica role from Patroni), "" if unknown
+	nodeRole string
+	// masterDB is the database of masterDBOnly queries in this run
+	masterDB string
 )
 
 // Run is the former main(): it executes the full program flow.
@@ -54,50 +107,184 @@ func Run(ctxParent context.Context, fp *FlagParam, cp *ConnectionString) error {
 	flagParam = *fp
 	connParam = *cp
 
-	// 1) database list
-	dbList, err := resolveDBList(ctxParent)
+	if flagParam.interval > 0 {
+		return runResident(ctxParent)
+	}
+	return runOnce(ctxParent)
+}
+
+// runOnce performs a single collection over all databases and flushes the output
+func runOnce(ctxParent context.Context) error {
+	s, err := newSink(flagParam.outputFormat)
 	if err != nil {
 		return err
 	}
+	out = s
+
+	if err := loadState(); err != nil {
+		log.Printf("state file: %v", err)
+	}
+	defer func() {
+		if err := saveState(); err != nil {
+			log.Printf("state file: %v", err)
+		}
+	}()
+
+	// overall deadline for the whole run; cancellation also reaches in-flight
+	// queries, which pgx turns into a cancel request on the backend
+	ctx := ctxParent
+	if flagParam.deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctxParent, flagParam.deadline)
+		defer cancel()
+	}
 
-	// 2) role check (if requested)
-	if flagParam.masterOnly || flagParam.replicaOnly {
-		if err := checkDbRoleOnce(ctxParent); err != nil {
+	runSeries.Store(0)
+
+	if !discoveryMode() {
+		dbList, err := prepareTarget(ctx)
+		if err != nil {
 			return err
 		}
+		return errors.Join(collectDBs(ctx, dbList), out.close())
+	}
+
+	// discovered targets: one after another, a failing server does not stop the others
+	refreshTargets(ctx)
+	var skipped []string
+	for _, t := range targets {
+		if ctx.Err() != nil {
+			skipped = append(skipped, t.name)
+			continue
+		}
+		current = t
+		dbList, err := prepareTarget(ctx)
+		if err == nil {
+			err = collectDBs(ctx, dbList)
+		}
+		if err != nil {
+			log.Printf("target %s: %v", t.name, err)
+		}
+	}
+	current = target{}
+	flushErr := out.close()
+	if len(skipped) > 0 {
+		return errors.Join(fmt.Errorf("collection stopped (%v), unfinished targets: %s",
+			context.Cause(ctx), strings.Join(skipped, ",")), flushErr)
+	}
+	return flushErr
+}
+
+// prepareTarget resolves the database list and the node role of the current server
+func prepareTarget(ctx context.Context) ([]string, error) {
+	// 1) database list
+	dbList, err := resolveDBList(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// 2) role check (if requested by flags or by a query's role annotation);
+	// with -patroni-url the local Patroni is asked first
+	nodeRole, nodeLabels = "", nil
+	if flagParam.patroniURL != "" {
+		node, err := fetchPatroni(ctx, flagParam.patroniURL)
+		if err != nil {
+			log.Printf("WARN: %v; falling back to pg_is_in_recovery()", err)
+		} else {
+			if flagParam.patroniLabels {
+				nodeLabels = node.labels()
+			}
+			if err := out.write(relabelSamples(flagParam.relabel, node.samples())); err != nil {
+				return nil, fmt.Errorf("output error: %w", err)
+			}
+			if err := checkNodeRole(node.role); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if nodeRole == "" && flagParam.pooler == "" && (flagParam.masterOnly || flagParam.replicaOnly || queriesNeedRole(flagParam.queries)) {
+		if err := checkDbRoleOnce(ctx); err != nil {
+			return nil, err
+		}
 	}
 
-	// 3) parallel processing limited by -j
 	if len(dbList) == 0 {
-		return fmt.Errorf("no databases to process")
+		return nil, fmt.Errorf("no databases to process")
 	}
+	return dbList, nil
+}
+
+// collectDBs processes the databases of the current server, in parallel limited by -j
+func collectDBs(ctx context.Context, dbList []string) error {
+	masterDB = masterDBOf(dbList)
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		finished = make(map[string]bool, len(dbList))
+	)
 	sem := semaphore.NewWeighted(int64(flagParam.jobs))
 	for _, name := range dbList {
-		if err := sem.Acquire(ctxParent, 1); err != nil {
-			return fmt.Errorf("failed to acquire semaphore: %v", err)
+		if err := sem.Acquire(ctx, 1); err != nil {
+			break // deadline or signal: do not start the remaining databases
 		}
+		wg.Add(1)
 		go func(dbname string) {
+			defer wg.Done()
 			defer sem.Release(1)
 			defer func() {
 				if r := recover(); r != nil {
 					log.Printf("[db=%s] panic recovered: %v", dbname, r)
 				}
 			}()
-			if err := processDB(ctxParent, dbname); err != nil {
+			if err := processDB(ctx, dbname); err != nil {
 				log.Printf("DB %s: %v\n", dbname, err)
+				return
 			}
+			mu.Lock()
+			finished[dbname] = true
+			mu.Unlock()
 		}(name)
 	}
-	// wait for all goroutines to finish
-	if err := sem.Acquire(ctxParent, int64(flagParam.jobs)); err != nil {
-		return fmt.Errorf("final acquire: %v", err)
+	// wait for all goroutines to finish before the caller flushes the output
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		if unfinished := unfinishedDBs(dbList, finished); len(unfinished) > 0 {
+			return fmt.Errorf("collection stopped (%v), unfinished databases: %s",
+				context.Cause(ctx), strings.Join(unfinished, ","))
+		}
 	}
 	return nil
 }
 
+// queriesNeedRole reports whether any query is gated by a role annotation
+func queriesNeedRole(queries []queryDef) bool {
+	for _, q := range queries {
+		if q.role != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// unfinishedDBs lists databases (in input order) that were not fully processed
+func unfinishedDBs(dbList []string, finished map[string]bool) []string {
+	var list []string
+	for _, name := range dbList {
+		if !finished[name] {
+			list = append(list, name)
+		}
+	}
+	return list
+}
+
 func resolveDBList(ctxParent context.Context) ([]string, error) {
 	// if len(flagParam.datname) > 0 && strings.ToLower(flagParam.datname[0]) == "all" {
 	if len(flagParam.datname) > 0 && strings.EqualFold(flagParam.datname[0], "all") {
+		if flagParam.pooler != "" {
+			// the admin console is the only database of a pooler
+			return []string{poolerAdminDB(flagParam.pooler)}, nil
+		}
 		conn, cancelConn, err := connectDB(ctxParent, "postgres")
 		if err != nil {
 			return nil, err
@@ -106,7 +293,7 @@ func resolveDBList(ctxParent context.Context) ([]string, error) {
 		defer closeConn(ctxParent, conn)
 
 		rows, cancelQ, err := queryWithTimeout(ctxParent, conn,
-			"select datname from pg_database where datname not in ('template1','template0','postgres')")
+			"select datname from pg_database where datname not in ('template1','template0','postgres') order by datname", flagParam.pgTimeout)
 		if err != nil {
 			return nil, err
 		}
@@ -126,13 +313,57 @@ func resolveDBList(ctxParent context.Context) ([]string, error) {
 	return flagParam.datname, nil
 }
 
-// connectDB: timeout applies only to establishing the connection
+// connectDB: timeout applies only to establishing the connection.
+// The session starts with statement_timeout (and lock_timeout if requested) so the
+// server cancels runaway queries even if the client goes away, and read-only
+// unless -read-only=false.
 func connectDB(ctxParent context.Context, dbname string) (*pgx.Conn, context.CancelFunc, error) {
 	if dbname == "" {
 		dbname = "postgres"
 	}
+	cfg, err := pgx.ParseConfig(connString() + " dbname=" + dbname)
+	if err != nil {
+		return nil, nil, err
+	}
+	if connParam.password != "" {
+		cfg.Password = connParam.password
+	}
+	addSecret(cfg.Password) // may come from the conn string, PGPASSWORD or PGPASSFILE
+	params := make(map[string]string)
+	if flagParam.pooler != "" {
+		// admin consoles speak only the simple query protocol and reject
+		// unknown startup parameters
+		cfg.DefaultQueryExecMode = pgx.QueryExecModeSimpleProtocol
+	} else {
+		params["statement_timeout"] = pgMillis(queryDef{}.effectiveTimeout())
+		if flagParam.lockTimeout > 0 {
+			params["lock_timeout"] = pgMillis(flagParam.lockTimeout)
+		}
+		if flagParam.readOnly {
+			params["default_transaction_read_only"] = "on"
+		}
+	}
+	for k, v := range params {
+		cfg.RuntimeParams[k] = v
+	}
 	ctxConn, cancelConn := context.WithTimeout(ctxParent, flagParam.pgTimeout)
-	conn, err := pgx.Connect(ctxConn, connParam.connstr+" dbname="+dbname)
+	conn, err := pgx.ConnectConfig(ctxConn, cfg)
+	if err != nil && len(params) > 0 && startupParamsRejected(err) {
+		// poolers (pgbouncer, Odyssey) reject unknown startup parameters:
+		// connect without them and SET them in the session instead
+		for k := range params {
+			delete(cfg.RuntimeParams, k)
+		}
+		conn, err = pgx.ConnectConfig(ctxConn, cfg)
+		if err == nil {
+			var applied bool
+			if applied, err = setSessionParams(ctxConn, conn, dbname, params); err != nil {
+				closeConn(ctxParent, conn)
+			} else if !applied {
+				limitedSessions.Store(conn, true)
+			}
+		}
+	}
 	if err != nil {
 		cancelConn()
 		return nil, nil, err
@@ -140,9 +371,49 @@ func connectDB(ctxParent context.Context, dbname string) (*pgx.Conn, context.Can
 	return conn, cancelConn, nil
 }
 
+// limitedSessions holds connections whose server refused the session settings
+// (pooler admin consoles); they run with client-side timeouts only
+var limitedSessions sync.Map
+
+// startupParamsRejected reports whether a connection failed because the server
+// (usually a pooler) does not accept the startup parameters pg_watcher sends
+func startupParamsRejected(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+	msg := strings.ToLower(pgErr.Message)
+	return strings.Contains(msg, "startup parameter") || strings.Contains(msg, "unrecognized configuration parameter")
+}
+
+// setSessionParams applies session settings with SET, in name order (so
+// default_transaction_read_only comes first); it stops at the first one the
+// server refuses and reports whether all were applied. A refused read-only
+// setting is an error: pg_watcher does not collect from a writable session
+// unless -read-only=false is set.
+func setSessionParams(ctx context.Context, conn interface {
+	Exec(context.Context, string, ...any) (pgconn.CommandTag, error)
+}, dbname string, params map[string]string) (bool, error) {
+	for _, k := range slices.Sorted(maps.Keys(params)) {
+		if _, err := conn.Exec(ctx, "SET "+k+" = "+params[k]); err != nil {
+			if k == "default_transaction_read_only" {
+				return false, fmt.Errorf("SET %s refused, the session would not be read-only (use -read-only=false to allow it): %w", k, err)
+			}
+			log.Printf("WARN: [db=%s] SET %s refused (%v); running with client-side timeouts only", dbname, k, err)
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// querier is the part of a connection collectQuery needs; tests pass pgxmock
+type querier interface {
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+}
+
 // queryWithTimeout: per-query timeout
-func queryWithTimeout(ctxParent context.Context, conn *pgx.Conn, sql string) (pgx.Rows, context.CancelFunc, error) {
-	ctxQ, cancelQ := context.WithTimeout(ctxParent, flagParam.pgTimeout)
+func queryWithTimeout(ctxParent context.Context, conn querier, sql string, timeout time.Duration) (pgx.Rows, context.CancelFunc, error) {
+	ctxQ, cancelQ := context.WithTimeout(ctxParent, timeout)
 	rows, err := conn.Query(ctxQ, sql)
 	if err != nil {
 		cancelQ()
@@ -151,7 +422,8 @@ func queryWithTimeout(ctxParent context.Context, conn *pgx.Conn, sql string) (pg
 	return rows, cancelQ, nil
 }
 
-// checkDbRoleOnce: verifies node role if master-only / replica-only is requested
+// checkDbRoleOnce: detects the node role for role-gated queries and verifies it
+// if master-only / replica-only is requested
 func checkDbRoleOnce(ctxParent context.Context) error {
 	conn, cancelConn, err := connectDB(ctxParent, "postgres")
 	if err != nil {
@@ -161,7 +433,7 @@ func checkDbRoleOnce(ctxParent context.Context) error {
 	defer closeConn(ctxParent, conn)
 
 	rows, cancelQ, err := queryWithTimeout(ctxParent, conn,
-		"SELECT CASE WHEN pg_is_in_recovery() THEN 0 ELSE 1 END AS leader")
+		"SELECT CASE WHEN pg_is_in_recovery() THEN 0 ELSE 1 END AS leader", flagParam.pgTimeout)
 	if err != nil {
 		return err
 	}
@@ -178,10 +450,19 @@ func checkDbRoleOnce(ctxParent context.Context) error {
 		return err
 	}
 
-	if leader == 0 && flagParam.masterOnly {
+	if leader == 1 {
+		return checkNodeRole(rolePrimary)
+	}
+	return checkNodeRole(roleReplica)
+}
+
+// checkNodeRole sets nodeRole and enforces -master-only / -replica-only
+func checkNodeRole(role string) error {
+	nodeRole = role
+	if role != rolePrimary && flagParam.masterOnly {
 		return errors.New("INFO: --master-only requested but node is replica")
 	}
-	if leader == 1 && flagParam.replicaOnly {
+	if role == rolePrimary && flagParam.replicaOnly {
 		return errors.New("INFO: --replica-only requested but node is master")
 	}
 	return nil
@@ -189,123 +470,350 @@ func checkDbRoleOnce(ctxParent context.Context) error {
 
 // processDB: main metrics collection logic
 func processDB(parentCtx context.Context, dbname string) error {
-	conn, cancelConn, err := connectDB(parentCtx, dbname)
+	// the connection is opened on the first query that is not served from cache
+	var conn *pgx.Conn
+	defer func() {
+		if conn != nil {
+			closeConn(parentCtx, conn)
+		}
+	}()
+
+	// statement_timeout of the session, as set by connectDB
+	session := queryDef{}.effectiveTimeout()
+	// postmaster start time, fetched once for delta/rate reset detection
+	var serverStart string
+	startFetched, startKnown := false, false
+	for _, q := range flagParam.queries {
+		if !q.runsOn(nodeRole) || (q.masterDBOnly && dbname != masterDB) {
+			continue
+		}
+		if samples, ok := persist.cachedResult(dbname, q); ok {
+			if err := emit(limitCachedSeries(dbname, q, samples)); err != nil {
+				return fmt.Errorf("output error: %w", err)
+			}
+			continue
+		}
+		if conn == nil {
+			c, cancelConn, err := connectDB(parentCtx, dbname)
+			if err != nil {
+				return err
+			}
+			defer cancelConn()
+			conn = c
+		}
+		// sessions that refused SET keep the client-side timeout only
+		_, limited := limitedSessions.Load(conn)
+		if timeout := q.effectiveTimeout(); timeout != session && flagParam.pooler == "" && !limited {
+			if err := setStatementTimeout(parentCtx, conn, timeout); err != nil {
+				return err
+			}
+			session = timeout
+		}
+		samples, err := collectQuery(parentCtx, conn, dbname, q)
+		if err != nil {
+			return err
+		}
+		samples = limitCardinality(dbname, q, samples)
+		if q.hasTransforms() {
+			if !startFetched {
+				serverStart, startKnown = serverStartTime(parentCtx, conn)
+				startFetched = true
+			}
+			samples = persist.applyTransforms(dbname, q, samples, serverStart, startKnown)
+		}
+		samples = persist.storeResult(dbname, q, samples)
+		if err := emit(samples); err != nil {
+			return fmt.Errorf("output error: %w", err)
+		}
+	}
+	return nil
+}
+
+// emit writes samples to the output after adding node and target labels and relabeling
+func emit(samples []sample) error {
+	return out.write(relabelSamples(flagParam.relabel, withTargetLabels(withNodeLabels(samples))))
+}
+
+// setStatementTimeout changes the server-side statement_timeout for the following queries
+func setStatementTimeout(ctxParent context.Context, conn *pgx.Conn, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctxParent, flagParam.pgTimeout)
+	defer cancel()
+	if _, err := conn.Exec(ctx, "SET statement_timeout = "+pgMillis(timeout)); err != nil {
+		return fmt.Errorf("set statement_timeout: %w", err)
+	}
+	return nil
+}
+
+// collectQuery runs one statement and classifies its columns into labels and metrics
+func collectQuery(parentCtx context.Context, conn querier, dbname string, q queryDef) ([]sample, error) {
+	rows, cancelQ, err := queryWithTimeout(parentCtx, conn, q.sql, q.effectiveTimeout())
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("query error: %w", err)
 	}
-	defer cancelConn()
-	defer closeConn(parentCtx, conn)
+	defer cancelQ()
+	defer rows.Close()
 
-	for _, sqlText := range flagParam.sqlQuery {
-		if err := func(sqlText string) error {
-			rows, cancelQ, err := queryWithTimeout(parentCtx, conn, sqlText)
-			if err != nil {
-				return fmt.Errorf("query error: %w", err)
+	fds := rows.FieldDescriptions()
+
+	// precompute per-column metadata (iterate in fds order)
+	forced := makeForcedLabelsSet(q.forcedLabels())
+	prefix := q.prefix()
+	pivot := q.pivotOf()
+	jspec := q.jsonOf()
+	distMode := q.histogram != nil || q.summary != nil
+	if distMode {
+		pivot = nil // -pivot does not apply to histogram/summary queries
+	}
+	var distRows []distRow
+	type colMeta struct {
+		idx     int
+		name    string
+		ignored bool
+		forced  bool
+		label   string // normalized label name
+		metric  string // normalized metric name
+		kind    metricKind
+		unit    string
+		stamp   bool // column holds the sample timestamp
+		reset   bool // column marks counter resets (e.g. stats_reset)
+		pivot   int  // role in pivot mode
+		dist    bool // column feeds the histogram or summary
+		json    bool // json/jsonb column flattened by -json / -json-labels
+		array   bool // array column expanded by -arrays
+		arrays  arrayMode
+		numeric bool    // known metric column, text values are parsed as numbers
+		scale   float64 // factor applied to metric values (microseconds → seconds)
+	}
+	metas := make([]colMeta, 0, len(fds))
+	for i, fd := range fds {
+		name := fd.Name
+		mode, isArray := q.arrayModeOf(name)
+		metas = append(metas, colMeta{
+			idx:     i,
+			name:    name,
+			ignored: q.isIgnored(name),
+			forced:  forced[name],
+			label:   normalizeName(name),
+			metric:  normalizeName(fmt.Sprintf("%s_%s", prefix, name)),
+			kind:    q.kindOf(name),
+			unit:    unitFor(name),
+			stamp:   flagParam.timestampColumn != "" && name == flagParam.timestampColumn,
+			reset:   name == q.resetColumnName(),
+			pivot:   pivot.columnRole(name),
+			dist:    q.isDistColumn(name),
+			json:    jspec.hasColumn(name),
+			array:   isArray,
+			arrays:  mode,
+			scale:   1,
+		})
+		if pc, ok := poolerColumnOf(q, name); ok {
+			m := &metas[len(metas)-1]
+			if pc.label {
+				m.forced = true
+				continue
+			}
+			suffix, unit, scale := pc.apply(name)
+			m.numeric, m.scale = true, scale
+			m.metric = normalizeName(prefix + "_" + suffix)
+			if unit != "" {
+				m.unit = unit
 			}
-			defer cancelQ()
-			defer rows.Close()
-
-			fds := rows.FieldDescriptions()
-
-			// precompute per-column metadata (iterate in fds order)
-			forced := makeForcedLabelsSet(flagParam.labelColumnsArr)
-			type colMeta struct {
-				idx     int
-				name    string
-				ignored bool
-				forced  bool
-				label   string // normalized label name
-				metric  string // normalized metric name
+			if _, typed := q.kinds[name]; !typed {
+				m.kind = pc.kind
 			}
-			metas := make([]colMeta, 0, len(fds))
-			for i, fd := range fds {
-				name := fd.Name
-				ignored := false
-				if flagParam.ignoredColumns != nil {
-					_, ignored = flagParam.ignoredColumns[name]
+		}
+	}
+
+	var samples []sample
+	for rows.Next() {
+		vals, err := rows.Values()
+		if err != nil {
+			return nil, fmt.Errorf("scan values: %w", err)
+		}
+		// safety guard: values must match field count
+		if len(vals) != len(fds) {
+			log.Printf("[db=%s] row mismatch: vals=%d fds=%d", dbname, len(vals), len(fds))
+			continue
+		}
+
+		var labels []label
+		rowStart := len(samples)
+		var resetMark string
+		var pivotName, pivotUnit string
+		var pivotVal any
+		// extra labels of array element samples, by sample index
+		var elementLabels map[int][]label
+		var distVals map[string]any
+		if distMode {
+			distVals = make(map[string]any)
+		}
+		var ts time.Time
+		if flagParam.timestamps {
+			ts = time.Now()
+		}
+
+		// single pass over columns in SELECT order
+		for _, m := range metas {
+			if m.stamp {
+				if t, ok := toTime(vals[m.idx]); ok {
+					ts = t
 				}
-				metas = append(metas, colMeta{
-					idx:     i,
-					name:    name,
-					ignored: ignored,
-					forced:  forced[name],
-					label:   normalizeName(name),
-					metric:  normalizeName(fmt.Sprintf("%s_%s", flagParam.prefixMetric, name)),
-				})
+				continue
+			}
+			if m.reset {
+				resetMark = resetMarker(vals[m.idx])
+				continue
+			}
+			if m.ignored {
+				continue
+			}
+			if m.idx < 0 || m.idx >= len(vals) {
+				continue
 			}
+			v := vals[m.idx]
 
-			for rows.Next() {
-				vals, err := rows.Values()
-				if err != nil {
-					return fmt.Errorf("scan values: %w", err)
+			if m.dist {
+				distVals[m.name] = v
+				continue
+			}
+
+			if m.json {
+				if v == nil {
+					continue
 				}
-				// safety guard: values must match field count
-				if len(vals) != len(fds) {
-					log.Printf("[db=%s] row mismatch: vals=%d fds=%d", dbname, len(vals), len(fds))
+				leaves, jsonLabels, err := jspec.expandJSON(m.name, v)
+				if err != nil {
+					log.Printf("[db=%s] %v", dbname, err)
 					continue
 				}
-
-				var lb strings.Builder
-				first := true
-
-				type mval struct {
-					name string
-					val  float64
+				labels = append(labels, jsonLabels...)
+				for _, leaf := range leaves {
+					column := strings.ReplaceAll(leaf.path, ".", "_")
+					samples = append(samples, sample{
+						name:   normalizeName(prefix + "_" + column),
+						prefix: prefix,
+						column: column,
+						db:     dbname,
+						value:  leaf.value,
+						kind:   q.kindOf(column),
+						unit:   unitFor(column),
+						help:   q.help[column],
+					})
 				}
-				metricsBuf := make([]mval, 0, len(metas))
-
-				// single pass over columns in SELECT order
-				for _, m := range metas {
-					if m.ignored {
-						continue
-					}
-					if m.idx < 0 || m.idx >= len(vals) {
-						continue
-					}
-					v := vals[m.idx]
+				continue
+			}
 
-					// labels: forced columns are always labels; otherwise strings become labels
-					if m.forced {
-						if !first {
-							lb.WriteByte(',')
-						}
-						fmt.Fprintf(&lb, `%s="%s"`, m.label, labelVal(v))
-						first = false
-						continue // do not duplicate as metric
-					}
-					switch v.(type) {
-					case string, []byte:
-						if !first {
-							lb.WriteByte(',')
+			if m.array {
+				elems, ok := flattenArray(v)
+				if !ok {
+					continue // NULL or not an array
+				}
+				for _, e := range expandArray(m.name, m.arrays, elems) {
+					column := m.name + e.suffix
+					if len(e.labels) > 0 {
+						if elementLabels == nil {
+							elementLabels = make(map[int][]label)
 						}
-						fmt.Fprintf(&lb, `%s="%s"`, m.label, labelVal(v))
-						first = false
-						continue
+						elementLabels[len(samples)] = e.labels
 					}
+					samples = append(samples, sample{
+						name:   normalizeName(prefix + "_" + column),
+						prefix: prefix,
+						column: column,
+						db:     dbname,
+						value:  e.value,
+						kind:   q.kindOf(column),
+						unit:   unitFor(column),
+						help:   q.help[column],
+					})
+				}
+				continue
+			}
 
-					// metrics: only numeric
-					if f, ok := toFloat64(v); ok && !math.IsNaN(f) && !math.IsInf(f, 0) {
-						metricsBuf = append(metricsBuf, mval{name: m.metric, val: f})
-					}
+			switch m.pivot {
+			case pivotNameCol:
+				if v != nil {
+					pivotName = labelVal(v)
+				}
+				continue
+			case pivotValueCol:
+				pivotVal = v
+				continue
+			case pivotUnitCol:
+				if v != nil {
+					pivotUnit = labelVal(v)
 				}
+				continue
+			}
 
-				labels := lb.String()
+			// metric_column mode: every other column is a label, NULLs are left out
+			if pivot != nil && pivot.allLabels {
+				if v != nil {
+					labels = append(labels, label{name: m.label, value: labelVal(v)})
+				}
+				continue
+			}
 
-				// print all metrics with the prepared label set
-				for _, it := range metricsBuf {
-					if labels != "" {
-						fmt.Printf("%s{%s,db=%q} %g\n", it.name, labels, dbname, it.val)
-					} else {
-						fmt.Printf("%s{db=%q} %g\n", it.name, dbname, it.val)
-					}
+			// labels: forced columns are always labels; otherwise strings become labels
+			if m.forced {
+				labels = append(labels, label{name: m.label, value: labelVal(v)})
+				continue // do not duplicate as metric
+			}
+			switch v.(type) {
+			case string, []byte:
+				if !m.numeric {
+					labels = append(labels, label{name: m.label, value: labelVal(v)})
+					continue
 				}
 			}
-			return rows.Err()
-		}(sqlText); err != nil {
-			return err
+
+			// in pivot and histogram/summary modes the designated columns are the only metrics
+			if pivot != nil || distMode {
+				continue
+			}
+
+			// metrics: only numeric
+			if f, ok := toFloat64(v); ok && !math.IsNaN(f) && !math.IsInf(f, 0) {
+				samples = append(samples, sample{
+					name:   m.metric,
+					prefix: prefix,
+					column: m.name,
+					db:     dbname,
+					value:  f * m.scale,
+					kind:   m.kind,
+					unit:   m.unit,
+					help:   q.help[m.name],
+				})
+			}
+		}
+
+		if distMode {
+			distRows = append(distRows, distRow{labels: labels, ts: ts, vals: distVals})
+			continue
+		}
+		if pivot != nil {
+			if s, ok := pivotSample(q, prefix, dbname, pivotName, pivotUnit, pivotVal); ok {
+				samples = append(samples, s)
+			}
+		}
+
+		// every metric of the row shares the label set, timestamp and reset marker collected above
+		for i := rowStart; i < len(samples); i++ {
+			samples[i].labels = labels
+			if extra, ok := elementLabels[i]; ok {
+				samples[i].labels = append(append([]label(nil), labels...), extra...)
+			}
+			samples[i].ts = ts
+			samples[i].resetMark = resetMark
 		}
 	}
-	return nil
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if distMode {
+		samples = synthesizeDistribution(q, prefix, dbname, distRows)
+	}
+	return samples, nil
 }
 
 // ParseFlags is your former processingFlag() but:
@@ -315,30 +823,113 @@ func processDB(parentCtx context.Context, dbname string) error {
 func ParseFlags(build string) (*FlagParam, *ConnectionString, error) {
 	version := flag.Bool("version", false, "print current version")
 	connPtr := flag.String("conn", "user=postgres host=127.0.0.1 port=5435", "PostgreSQL conn string (libpq format)")
+	connFile := flag.String("conn-file", "", "File holding the conn string, instead of -conn (keeps the password out of ps and shell history)")
+	connEnv := flag.String("conn-env", "", "Environment variable holding the conn string, instead of -conn")
+	passwordFile := flag.String("password-file", "", "File holding the password; overrides the conn string, PGPASSWORD and PGPASSFILE, re-read every -interval")
+	targetsFile := flag.String("targets-file", "", "JSON/YAML file listing servers (targets + labels, as Prometheus file_sd); entries extend -conn, re-read every -interval")
+	dnsSRV := flag.String("dns-srv", "", "DNS SRV names whose records are the servers to collect from (comma-separated); resolved every -interval")
 	pgTimeout := flag.Duration("pg-timeout", 5*time.Second, "Global timeout for PostgreSQL operations (connect + query)")
-	dbnamePtr := flag.String("db-name", "", "DB name(s): 'all' or comma-separated list")
+	queryTimeout := flag.Duration("query-timeout", 0, "Default per-query timeout, also set as server-side statement_timeout (default -pg-timeout)")
+	lockTimeout := flag.Duration("lock-timeout", 0, "Server-side lock_timeout for collection sessions (0 = server default)")
+	readOnlyPtr := flag.Bool("read-only", true, "Open every session with default_transaction_read_only=on")
+	sqlCheckPtr := flag.Bool("sql-check", false, "Reject statements other than SELECT, SHOW, TABLE and WITH ... SELECT before running")
+	deadline := flag.Duration("deadline", 0, "Overall deadline for the whole run (per cycle with -interval); unfinished databases are reported (0 = none)")
+	stateFile := flag.String("state-file", "", "File keeping cached query results between runs")
+	cacheAgeMetric := flag.Bool("cache-age-metric", false, "Emit <prefix>_cache_age_seconds for query results served from cache")
+	interval := flag.Duration("interval", 0, "Stay resident and collect every interval, reloading changed SQL files (0 = run once)")
+	dbnamePtr := flag.String("db-name", "", "DB name(s): 'all' or comma-separated list (with -pooler defaults to the admin console)")
+	poolerPtr := flag.String("pooler", "", "Scrape a connection pooler admin console: pgbouncer or odyssey")
 	sqlPtr := flag.String("sql-cmd", "", "SQL query text")
 	sqlfilePtr := flag.String("sql-file", "", "File with SQL command(s)")
+	queriesYAMLPtr := flag.String("queries-yaml", "", "postgres_exporter queries.yaml file with custom metric definitions")
+	sqlDirPtr := flag.String("sql-dir", "", "Directory (all *.sql files) or glob pattern of SQL files; each file is a named query group")
 	labelsPtr := flag.String("labels", "", "Label columns (comma-separated). If not specified, all string columns will be used as labels.")
 	ignoredColumnsPtr := flag.String("ignoredColumns", "", "Columns to exclude (comma-separated)")
-	SQLSpliter := flag.String("SQLSpliter", "", "Delimiter for splitting multiple SQL commands")
+	SQLSpliter := flag.String("SQLSpliter", "", "Delimiter for splitting multiple SQL commands (\";\" understands quotes, comments and $$ bodies)")
 	masterOnlyPtr := flag.Bool("master-only", false, "Execute only on master")
 	replicaOnlyPtr := flag.Bool("replica-only", false, "Execute only on replica")
 	prefixMetric := flag.String("prefixMetric", "pgwatch", "Metric prefix")
 	jobsPtr := flag.Int("j", 1, "Max concurrent databases to process")
+	countersPtr := flag.String("counters", "", "Columns holding cumulative counters (comma-separated)")
+	deltaPtr := flag.String("delta", "", "Cumulative columns to emit as the difference to the previous run (comma-separated)")
+	ratePtr := flag.String("rate", "", "Cumulative columns to emit as a per-second rate since the previous run (comma-separated)")
+	resetColumnPtr := flag.String("reset-column", "", "Column whose change marks a counter reset for -delta/-rate (e.g. stats_reset)")
+	maxSeriesPtr := flag.Int("max-series", 0, "Maximum series per run over all databases; excess series are dropped (0 = unlimited)")
+	maxQuerySeriesPtr := flag.Int("max-series-per-query", 0, "Maximum series per query and database; excess series are dropped (0 = unlimited)")
+	maxLabelLengthPtr := flag.Int("max-label-length", 0, "Maximum label value length in characters (0 = unlimited)")
+	labelOverflowPtr := flag.String("label-overflow", overflowHash, "How to shorten long label values: hash (keep a prefix plus a hash) or truncate")
+	pivotPtr := flag.String("pivot", "", "Key/value mode: name_column,value_column[,unit_column]; each row becomes <prefix>_<name>")
+	metricColumnPtr := flag.String("metric-column", "", "Metric name column mode: name_column,value_column[,unit_column]; all other columns become labels")
+	jsonPtr := flag.String("json", "", "JSON paths (column or column.key...) whose numeric leaves become metrics (comma-separated)")
+	jsonLabelsPtr := flag.String("json-labels", "", "JSON paths of string leaves that become labels (comma-separated)")
+	arraysPtr := flag.String("arrays", "", "Array column expansion: col=elements or col=len|sum|min|max|avg (comma-separated)")
+	patroniURL := flag.String("patroni-url", "", "Local Patroni REST API (e.g. http://127.0.0.1:8008) used for the node role and patroni metrics")
+	patroniLabels := flag.Bool("patroni-labels", false, "Add patroni_scope, patroni_member and patroni_role labels to every series (needs -patroni-url)")
+	relabelConfig := flag.String("relabel-config", "", "YAML file with Prometheus-style relabel rules applied to every series before output")
+	outputFormat := flag.String("output-format", formatPrometheus, "Output format: prometheus, openmetrics, otlp, graphite or statsd")
+	timestampsPtr := flag.Bool("timestamps", false, "Attach the collection time to every sample")
+	timestampColumn := flag.String("timestamp-column", "", "Column whose value is used as the sample timestamp (excluded from output)")
+	unitsPtr := flag.String("units", "", "Units of metric columns (col=unit, comma-separated), e.g. size=bytes")
+	outputAddr := flag.String("output-addr", "", "Graphite/StatsD destination (tcp://host:port or udp://host:port); stdout if empty")
+	otlpEndpoint := flag.String("otlp-endpoint", "", "OTLP collector endpoint (default "+defaultOTLPHTTPEndpoint+" for http/protobuf, "+defaultOTLPGRPCEndpoint+" for grpc)")
+	otlpProtocol := flag.String("otlp-protocol", otlpProtocolHTTP, "OTLP transport: http/protobuf or grpc")
+	otlpHeaders := flag.String("otlp-headers", "", "Extra OTLP request headers (k=v, comma-separated)")
+	otlpTimeout := flag.Duration("otlp-timeout", 10*time.Second, "Timeout for the OTLP export")
 
 	flag.Parse()
+	log.SetOutput(redactWriter{w: os.Stderr})
 
 	if *version {
 		fmt.Println(build)
 		os.Exit(0)
 	}
+	pooler, err := parsePooler(*poolerPtr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("ERROR: %w", err)
+	}
+	flagParam.pooler = pooler
+	if pooler != "" && (*masterOnlyPtr || *replicaOnlyPtr) {
+		return nil, nil, errors.New("ERROR: -master-only and -replica-only do not apply to -pooler")
+	}
+	if *dbnamePtr == "" && pooler != "" {
+		*dbnamePtr = poolerAdminDB(pooler)
+	}
 	if *dbnamePtr == "" {
 		return nil, nil, errors.New("ERROR: -db-name must be specified (use 'all' or list)")
 	}
 	flagParam.datname = strings.Split(*dbnamePtr, ",")
-	connParam.connstr = *connPtr
+	connSources := 0
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "conn" || f.Name == "conn-file" || f.Name == "conn-env" {
+			connSources++
+		}
+	})
+	if connSources > 1 {
+		return nil, nil, errors.New("ERROR: use either -conn, -conn-file or -conn-env")
+	}
+	connstr, err := resolveConnString(*connPtr, *connFile, *connEnv)
+	if err != nil {
+		return nil, nil, fmt.Errorf("ERROR: %w", err)
+	}
+	connParam.connstr = connstr
+	if cfg, err := pgx.ParseConfig(connstr); err == nil {
+		addSecret(cfg.Password)
+	}
+	flagParam.passwordFile = strings.TrimSpace(*passwordFile)
+	if flagParam.passwordFile != "" {
+		pw, err := readPasswordFile(flagParam.passwordFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("ERROR: -password-file: %w", err)
+		}
+		connParam.password = pw
+	}
 	flagParam.pgTimeout = *pgTimeout
+	flagParam.queryTimeout = *queryTimeout
+	flagParam.lockTimeout = *lockTimeout
+	flagParam.deadline = *deadline
+	flagParam.interval = *interval
+	flagParam.stateFile = *stateFile
+	flagParam.cacheAgeMetric = *cacheAgeMetric
 
 	if *labelsPtr != "" {
 		for _, it := range strings.Split(*labelsPtr, ",") {
@@ -352,50 +943,141 @@ func ParseFlags(build string) (*FlagParam, *ConnectionString, error) {
 		}
 	}
 
-	if (*sqlPtr == "" && *sqlfilePtr == "") || (*sqlPtr != "" && *sqlfilePtr != "") {
-		return nil, nil, errors.New("ERROR: use either -sql-cmd or -sql-file (exactly one)")
-	}
-	if *sqlPtr != "" {
-		if *SQLSpliter != "" {
-			flagParam.sqlQuery = strings.Split(strings.TrimRight(*sqlPtr, ";"), *SQLSpliter)
-		} else {
-			flagParam.sqlQuery = append(flagParam.sqlQuery, *sqlPtr)
+	flagParam.deltaColumns = makeForcedLabelsSet(splitList(*deltaPtr))
+	flagParam.rateColumns = makeForcedLabelsSet(splitList(*ratePtr))
+	flagParam.resetColumn = strings.TrimSpace(*resetColumnPtr)
+	if *countersPtr != "" {
+		flagParam.counterColumns = make(map[string]bool)
+		for _, it := range strings.Split(*countersPtr, ",") {
+			flagParam.counterColumns[strings.TrimSpace(it)] = true
 		}
 	}
-	if *sqlfilePtr != "" {
-		content, err := os.ReadFile(*sqlfilePtr)
-		if err != nil {
-			return nil, nil, fmt.Errorf("failed to read SQL file: %w", err)
-		}
-		sqlText := string(content)
-		if *SQLSpliter != "" {
-			flagParam.sqlQuery = strings.Split(strings.TrimRight(sqlText, ";"), *SQLSpliter)
-		} else {
-			flagParam.sqlQuery = append(flagParam.sqlQuery, sqlText)
+
+	sources := 0
+	for _, p := range []string{*sqlPtr, *sqlfilePtr, *sqlDirPtr, *queriesYAMLPtr} {
+		if p != "" {
+			sources++
 		}
 	}
-	if *SQLSpliter != "" {
-		flagParam.SQLSpliter = *SQLSpliter
+	if sources != 1 {
+		return nil, nil, errors.New("ERROR: use either -sql-cmd, -sql-file, -sql-dir or -queries-yaml (exactly one)")
 	}
+	flagParam.sqlCmd = *sqlPtr
+	flagParam.sqlFile = *sqlfilePtr
+	flagParam.sqlDir = *sqlDirPtr
+	flagParam.queriesYAML = *queriesYAMLPtr
+	flagParam.SQLSpliter = *SQLSpliter
+	queries, err := loadQueries()
+	if err != nil {
+		return nil, nil, fmt.Errorf("ERROR: %w", err)
+	}
+	flagParam.readOnly = *readOnlyPtr
+	flagParam.sqlCheck = *sqlCheckPtr
+	if err := validateQueries(queries); err != nil {
+		return nil, nil, fmt.Errorf("ERROR: %w", err)
+	}
+	flagParam.queries = queries
 
 	flagParam.masterOnly = *masterOnlyPtr
 	flagParam.replicaOnly = *replicaOnlyPtr
-	if *prefixMetric != "" {
-		flagParam.prefixMetric = *prefixMetric
+	// postgres_exporter metrics carry no prefix, so queries.yaml mode accepts an empty one
+	if *prefixMetric == "" && flagParam.queriesYAML == "" {
+		*prefixMetric = "pgwatch"
 	}
+	flagParam.prefixMetric = *prefixMetric
 	if *jobsPtr <= 0 {
 		*jobsPtr = 1
 	}
 	flagParam.jobs = *jobsPtr
 
+	flagParam.maxSeries = *maxSeriesPtr
+	flagParam.maxQuerySeries = *maxQuerySeriesPtr
+	flagParam.maxLabelLength = *maxLabelLengthPtr
+	overflow, err := parseLabelOverflow(*labelOverflowPtr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("ERROR: %w", err)
+	}
+	flagParam.labelOverflow = overflow
+	if *pivotPtr != "" {
+		p, err := parsePivot(*pivotPtr)
+		if err != nil {
+			return nil, nil, fmt.Errorf("ERROR: -pivot: %w", err)
+		}
+		flagParam.pivot = p
+	}
+	if *metricColumnPtr != "" {
+		if flagParam.pivot != nil {
+			return nil, nil, errors.New("ERROR: use either -pivot or -metric-column")
+		}
+		p, err := parseMetricColumn(*metricColumnPtr)
+		if err != nil {
+			return nil, nil, fmt.Errorf("ERROR: -metric-column: %w", err)
+		}
+		flagParam.pivot = p
+	}
+	flagParam.patroniURL = strings.TrimSpace(*patroniURL)
+	flagParam.patroniLabels = *patroniLabels
+	flagParam.targetsFile = strings.TrimSpace(*targetsFile)
+	if flagParam.targetsFile != "" {
+		if err := readTargets(); err != nil {
+			return nil, nil, fmt.Errorf("ERROR: -targets-file: %w", err)
+		}
+	}
+	flagParam.dnsSRV = splitList(*dnsSRV)
+	// a bad -conn is reported when connecting, as before
+	if hosts, err := connHosts(connParam.connstr); err == nil && len(hosts) > 1 {
+		if _, err := newTargets(connParam.connstr, nil); err != nil {
+			return nil, nil, fmt.Errorf("ERROR: -conn: %w", err)
+		}
+		flagParam.multiHost = true
+	}
+	if discoveryMode() && flagParam.patroniURL != "" {
+		return nil, nil, errors.New("ERROR: -patroni-url applies to a single server, not to discovered targets")
+	}
+	flagParam.json = parseJSONSpec(*jsonPtr, *jsonLabelsPtr)
+	arrays, err := parseArrayModes(*arraysPtr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("ERROR: -arrays: %w", err)
+	}
+	flagParam.arrays = arrays
+	if *relabelConfig != "" {
+		rules, err := loadRelabelConfig(*relabelConfig)
+		if err != nil {
+			return nil, nil, fmt.Errorf("ERROR: %w", err)
+		}
+		flagParam.relabel = rules
+	}
+	flagParam.relabelConfig = *relabelConfig
+
+	flagParam.outputFormat = *outputFormat
+	flagParam.otlpEndpoint = *otlpEndpoint
+	flagParam.otlpProtocol = *otlpProtocol
+	flagParam.otlpTimeout = *otlpTimeout
+	flagParam.outputAddr = *outputAddr
+	flagParam.timestamps = *timestampsPtr
+	flagParam.timestampColumn = strings.TrimSpace(*timestampColumn)
+	units, err := parseKeyValueList(*unitsPtr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("ERROR: -units: %w", err)
+	}
+	flagParam.columnUnits = units
+	headers, err := parseKeyValueList(*otlpHeaders)
+	if err != nil {
+		return nil, nil, fmt.Errorf("ERROR: -otlp-headers: %w", err)
+	}
+	flagParam.otlpHeaders = headers
+	flagParam.build = build
+
 	return &flagParam, &connParam, nil
 }
 
-// closeConn closes connection with its own timeout
+// closeConn closes connection with its own timeout; it still runs after the
+// parent is canceled so the backend gets a proper Terminate message
 func closeConn(ctxParent context.Context, c *pgx.Conn) {
-	ctx, cancel := context.WithTimeout(ctxParent, flagParam.pgTimeout)
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctxParent), flagParam.pgTimeout)
 	defer cancel()
 	_ = c.Close(ctx)
+	limitedSessions.Delete(c)
 }
 
 // toFloat64 converts most numeric-like values to float64
@@ -452,6 +1134,25 @@ func toFloat64(v any) (float64, bool) {
 	return 0, false
 }
 
+// toTime converts timestamp-like values (time, unix seconds, RFC 3339 text) to time.Time
+func toTime(v any) (time.Time, bool) {
+	switch x := v.(type) {
+	case time.Time:
+		return x, true
+	case string:
+		if t, err := time.Parse(time.RFC3339Nano, x); err == nil {
+			return t, true
+		}
+	case []byte:
+		return toTime(string(x))
+	}
+	if f, ok := toFloat64(v); ok && !math.IsNaN(f) && !math.IsInf(f, 0) {
+		sec, frac := math.Modf(f)
+		return time.Unix(int64(sec), int64(frac*1e9)), true
+	}
+	return time.Time{}, false
+}
+
 // normalizeName converts arbitrary column/metric names into Prometheus-friendly identifiers
 func normalizeName(s string) string {
 	s = strings.ToLower(s)
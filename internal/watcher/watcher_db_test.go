@@ -2,9 +2,12 @@ package watcher
 
 import (
 	"context"
+	"fmt"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/pashagolub/pgxmock/v3"
 )
 
@@ -241,3 +244,271 @@ func TestQueryError_Mock(t *testing.T) {
 		t.Errorf("unfulfilled expectations: %v", err)
 	}
 }
+
+// Test the SET fallback for servers that reject startup parameters
+func TestSetSessionParams_Mock(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("failed to create mock: %v", err)
+	}
+	defer mock.Close(context.Background())
+
+	params := map[string]string{"statement_timeout": "5000", "lock_timeout": "100"}
+	mock.ExpectExec("SET lock_timeout = 100").WillReturnResult(pgxmock.NewResult("SET", 0))
+	mock.ExpectExec("SET statement_timeout = 5000").WillReturnResult(pgxmock.NewResult("SET", 0))
+	if ok, err := setSessionParams(context.Background(), mock, "app", params); !ok || err != nil {
+		t.Errorf("setSessionParams() = %v, %v, want true", ok, err)
+	}
+
+	// an admin console refuses SET: stop and report it
+	mock.ExpectExec("SET lock_timeout").WillReturnError(&pgconn.PgError{Message: "unknown command"})
+	if ok, err := setSessionParams(context.Background(), mock, "console", params); ok || err != nil {
+		t.Errorf("setSessionParams() = %v, %v after a refused SET, want false without error", ok, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestStartupParamsRejected(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{fmt.Errorf("connect: %w", &pgconn.PgError{Code: "08P01", Message: "unsupported startup parameter: statement_timeout"}), true},
+		{&pgconn.PgError{Code: "42704", Message: `unrecognized configuration parameter "lock_timeout"`}, true},
+		{&pgconn.PgError{Code: "28P01", Message: "password authentication failed"}, false},
+		{context.DeadlineExceeded, false},
+	}
+	for _, tt := range tests {
+		if got := startupParamsRejected(tt.err); got != tt.want {
+			t.Errorf("startupParamsRejected(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+// Test that a session which cannot be made read-only fails the connection
+func TestSetSessionParamsReadOnly_Mock(t *testing.T) {
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("failed to create mock: %v", err)
+	}
+	defer mock.Close(context.Background())
+
+	params := map[string]string{"statement_timeout": "5000", "default_transaction_read_only": "on"}
+	mock.ExpectExec("SET default_transaction_read_only = on").WillReturnError(&pgconn.PgError{Message: "unsupported"})
+	if ok, err := setSessionParams(context.Background(), mock, "app", params); ok || err == nil || !strings.Contains(err.Error(), "-read-only=false") {
+		t.Errorf("setSessionParams() = %v, %v, want an error for a refused read-only setting", ok, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+// Test collectQuery in every output mode against mocked result sets
+func TestCollectQueryModes_Mock(t *testing.T) {
+	tests := []struct {
+		name    string
+		sql     string
+		pooler  string
+		columns []string
+		rows    [][]any
+		want    map[string]float64
+	}{
+		{
+			name:    "plain",
+			sql:     "-- name: db\nselect datname, numbackends from pg_stat_database",
+			columns: []string{"datname", "numbackends"},
+			rows:    [][]any{{"app", int64(3)}},
+			want:    map[string]float64{`pgwatch_db_numbackends{datname="app"}`: 3},
+		},
+		{
+			name:    "pivot",
+			sql:     "-- name: settings\n-- pivot: name, setting, unit\nselect name, setting, unit from pg_settings",
+			columns: []string{"name", "setting", "unit"},
+			rows:    [][]any{{"shared_buffers", "16384", "8kB"}, {"fsync", "on", nil}, {"wal_level", "replica", nil}},
+			want: map[string]float64{
+				"pgwatch_settings_shared_buffers": 134217728,
+				"pgwatch_settings_fsync":          1,
+			},
+		},
+		{
+			name:    "metric_column",
+			sql:     "-- name: tup\n-- metric_column: metric, value\nselect datname, relid, 'inserted' as metric, n_tup_ins as value from t",
+			columns: []string{"datname", "relid", "metric", "value"},
+			rows:    [][]any{{"app", int64(16384), "inserted", int64(5)}},
+			want:    map[string]float64{`pgwatch_tup_inserted{datname="app",relid="16384"}`: 5},
+		},
+		{
+			name:    "histogram",
+			sql:     "-- name: lat\n-- histogram: le, cnt\nselect le, cnt from buckets",
+			columns: []string{"le", "cnt"},
+			rows:    [][]any{{0.1, int64(2)}, {1.0, int64(3)}, {nil, int64(1)}},
+			want: map[string]float64{
+				`pgwatch_lat_bucket{le="0.1"}`:  2,
+				`pgwatch_lat_bucket{le="1"}`:    5,
+				`pgwatch_lat_bucket{le="+Inf"}`: 6,
+				"pgwatch_lat_count":             6,
+			},
+		},
+		{
+			name:    "summary",
+			sql:     "-- name: lat\n-- summary: p50=0.5, p99=0.99\n-- summary_count: n\nselect p50, p99, n from q",
+			columns: []string{"p50", "p99", "n"},
+			rows:    [][]any{{1.0, 2.0, int64(10)}},
+			want: map[string]float64{
+				`pgwatch_lat{quantile="0.5"}`:  1,
+				`pgwatch_lat{quantile="0.99"}`: 2,
+				"pgwatch_lat_count":            10,
+			},
+		},
+		{
+			name:    "json",
+			sql:     "-- name: j\n-- json: stats\nselect datname, stats from s",
+			columns: []string{"datname", "stats"},
+			rows:    [][]any{{"app", `{"io": {"reads": 5}}`}},
+			want:    map[string]float64{`pgwatch_j_stats_io_reads{datname="app"}`: 5},
+		},
+		{
+			name:    "arrays",
+			sql:     "-- name: a\n-- arrays: vals=elements|len|sum\nselect vals from s",
+			columns: []string{"vals"},
+			rows:    [][]any{{[]int64{1, 2, 3}}},
+			want: map[string]float64{
+				`pgwatch_a_vals{index="1"}`: 1,
+				`pgwatch_a_vals{index="2"}`: 2,
+				`pgwatch_a_vals{index="3"}`: 3,
+				"pgwatch_a_vals_len":        3,
+				"pgwatch_a_vals_sum":        6,
+			},
+		},
+		{
+			name:    "pooler",
+			sql:     "SHOW STATS;",
+			pooler:  poolerPgBouncer,
+			columns: []string{"database", "total_xact_time", "avg_recv"},
+			rows:    [][]any{{"pgbouncer", int64(2000000), int64(10)}},
+			want: map[string]float64{
+				`pgwatch_total_xact_time_seconds{database="pgbouncer"}`: 2,
+				`pgwatch_avg_recv_bytes{database="pgbouncer"}`:          10,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flagParam = FlagParam{prefixMetric: "pgwatch", pgTimeout: 5 * time.Second, pooler: tt.pooler}
+			q, err := parseQueryDef(tt.sql)
+			if err != nil {
+				t.Fatalf("parseQueryDef() error = %v", err)
+			}
+			mock, err := pgxmock.NewConn(pgxmock.QueryMatcherOption(pgxmock.QueryMatcherEqual))
+			if err != nil {
+				t.Fatalf("failed to create mock: %v", err)
+			}
+			defer mock.Close(context.Background())
+			rows := pgxmock.NewRows(tt.columns)
+			for _, r := range tt.rows {
+				rows.AddRow(r...)
+			}
+			mock.ExpectQuery(tt.sql).WillReturnRows(rows)
+
+			samples, err := collectQuery(context.Background(), mock, "app", q)
+			if err != nil {
+				t.Fatalf("collectQuery() error = %v", err)
+			}
+			got := make(map[string]float64, len(samples))
+			for _, s := range samples {
+				got[s.name+labelsString(s.labels)] = s.value
+			}
+			if len(got) != len(tt.want) {
+				t.Errorf("collectQuery() = %v, want %v", got, tt.want)
+			}
+			for k, v := range tt.want {
+				if g, ok := got[k]; !ok || g != v {
+					t.Errorf("%s = %v (present %v), want %v", k, g, ok, v)
+				}
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unfulfilled expectations: %v", err)
+			}
+		})
+	}
+}
+
+// Test that a failing query is reported by collectQuery
+func TestCollectQueryError_Mock(t *testing.T) {
+	flagParam = FlagParam{prefixMetric: "pgwatch", pgTimeout: 5 * time.Second}
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("failed to create mock: %v", err)
+	}
+	defer mock.Close(context.Background())
+	mock.ExpectQuery("select").WillReturnError(context.DeadlineExceeded)
+	if _, err := collectQuery(context.Background(), mock, "app", queryDef{sql: "select 1"}); err == nil {
+		t.Error("collectQuery() expected error")
+	}
+}
+
+// Test pivot mode on real SHOW ALL output, where units are part of the value text
+func TestCollectQueryShowAll_Mock(t *testing.T) {
+	flagParam = FlagParam{prefixMetric: "pgwatch", pgTimeout: 5 * time.Second}
+	q, err := parseQueryDef("-- name: setting\n-- pivot: name, setting\n-- ignore: description\nSHOW ALL")
+	if err != nil {
+		t.Fatalf("parseQueryDef() error = %v", err)
+	}
+	mock, err := pgxmock.NewConn()
+	if err != nil {
+		t.Fatalf("failed to create mock: %v", err)
+	}
+	defer mock.Close(context.Background())
+	mock.ExpectQuery("SHOW ALL").WillReturnRows(pgxmock.NewRows([]string{"name", "setting", "description"}).
+		AddRow("autovacuum_vacuum_cost_delay", "2ms", "Vacuum cost delay in milliseconds, for autovacuum.").
+		AddRow("checkpoint_timeout", "5min", "Sets the maximum time between automatic WAL checkpoints.").
+		AddRow("fsync", "on", "Forces synchronization of updates to disk.").
+		AddRow("log_min_duration_statement", "-1", "Sets the minimum execution time above which all statements will be logged.").
+		AddRow("max_connections", "100", "Sets the maximum number of concurrent connections.").
+		AddRow("random_page_cost", "4", "Sets the planner's estimate of the cost of a nonsequentially fetched disk page.").
+		AddRow("shared_buffers", "128MB", "Sets the number of shared memory buffers used by the server.").
+		AddRow("wal_buffers", "4MB", "Sets the number of disk-page buffers in shared memory for WAL.").
+		AddRow("wal_level", "replica", "Sets the level of information written to the WAL.").
+		AddRow("wal_segment_size", "16MB", "Shows the size of write ahead log segments.").
+		AddRow("work_mem", "4MB", "Sets the maximum memory to be used for query workspaces.").
+		AddRow("block_size", "8192", "Shows the size of a disk block.").
+		AddRow("temp_buffers", "8kB", "Sets the maximum number of temporary buffers used by each session.").
+		AddRow("data_directory", "/var/lib/postgresql/16/main", "Sets the server's data directory."))
+
+	samples, err := collectQuery(context.Background(), mock, "postgres", q)
+	if err != nil {
+		t.Fatalf("collectQuery() error = %v", err)
+	}
+	got := make(map[string]sample, len(samples))
+	for _, s := range samples {
+		got[s.name] = s
+	}
+	want := map[string]struct {
+		value float64
+		unit  string
+	}{
+		"pgwatch_setting_autovacuum_vacuum_cost_delay": {0.002, "seconds"},
+		"pgwatch_setting_checkpoint_timeout":           {300, "seconds"},
+		"pgwatch_setting_fsync":                        {1, ""},
+		"pgwatch_setting_log_min_duration_statement":   {-1, ""},
+		"pgwatch_setting_max_connections":              {100, ""},
+		"pgwatch_setting_random_page_cost":             {4, ""},
+		"pgwatch_setting_shared_buffers":               {128 << 20, "bytes"},
+		"pgwatch_setting_wal_buffers":                  {4 << 20, "bytes"},
+		"pgwatch_setting_wal_segment_size":             {16 << 20, "bytes"},
+		"pgwatch_setting_work_mem":                     {4 << 20, "bytes"},
+		"pgwatch_setting_block_size":                   {8192, ""},
+		"pgwatch_setting_temp_buffers":                 {8192, "bytes"},
+	}
+	if len(got) != len(want) {
+		t.Errorf("collectQuery() returned %d samples, want %d: %+v", len(got), len(want), samples)
+	}
+	for name, w := range want {
+		s, ok := got[name]
+		if !ok || s.value != w.value || s.unit != w.unit {
+			t.Errorf("%s = %v %q (present %v), want %v %q", name, s.value, s.unit, ok, w.value, w.unit)
+		}
+	}
+}
@@ -1,9 +1,12 @@
 package watcher
 
 import (
+	"context"
 	"encoding/json"
 	"math"
+	"strings"
 	"testing"
+	"time"
 )
 
 // Test toFloat64 conversion function
@@ -188,6 +191,24 @@ func TestRunWithNilParams(t *testing.T) {
 	}
 }
 
+// Test that a canceled run reports the databases it did not process
+func TestRunCanceledReportsUnfinished(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := Run(ctx, &FlagParam{datname: []string{"db1", "db2"}, jobs: 1}, &ConnectionString{})
+	if err == nil || !strings.Contains(err.Error(), "unfinished databases: db1,db2") {
+		t.Errorf("Run() error = %v, want unfinished databases report", err)
+	}
+}
+
+// Test unfinishedDBs keeps input order
+func TestUnfinishedDBs(t *testing.T) {
+	got := unfinishedDBs([]string{"a", "b", "c"}, map[string]bool{"b": true})
+	if strings.Join(got, ",") != "a,c" {
+		t.Errorf("unfinishedDBs() = %v, want [a c]", got)
+	}
+}
+
 // Test resolveDBList with specific database names
 func TestResolveDBListSpecific(t *testing.T) {
 	tests := []struct {
@@ -253,3 +274,31 @@ func floatEqual(a, b float64) bool {
 	}
 	return math.Abs(a-b) < epsilon
 }
+
+// Test toTime conversion of timestamp column values
+func TestToTime(t *testing.T) {
+	ref := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		name  string
+		input any
+		ok    bool
+	}{
+		{"time", ref, true},
+		{"rfc3339", "2024-01-02T03:04:05Z", true},
+		{"bytes", []byte("2024-01-02T03:04:05Z"), true},
+		{"epoch", float64(ref.Unix()), true},
+		{"invalid", "yesterday", false},
+		{"nil", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := toTime(tt.input)
+			if ok != tt.ok {
+				t.Fatalf("toTime(%v) ok = %v, want %v", tt.input, ok, tt.ok)
+			}
+			if ok && !got.Equal(ref) {
+				t.Errorf("toTime(%v) = %v, want %v", tt.input, got, ref)
+			}
+		})
+	}
+}